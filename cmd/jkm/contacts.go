@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/contacts"
+)
+
+// The contacts subcommand: `jkm contacts [list]`, `jkm contacts import <file.vcf>` and `jkm contacts export [file.vcf]`.
+// A file of "-" is standard input or output, which export writes to by default.
+func runContacts(cfg *configure.Config, args []string) error {
+	if cfg.ContactsPath == "" {
+		return errors.New("the address book isn't kept anywhere; set JKM_CONTACTS_PATH to keep it")
+	}
+	book, err := contacts.Open(cfg.ContactsPath, cfg.EmailAddress)
+	if err != nil {
+		return fmt.Errorf("opening contacts: %w", err)
+	}
+
+	command := "list"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch {
+	case command == "list" && len(args) == 0:
+		for _, contact := range book.Contacts() {
+			fmt.Printf("%s\t%d\n", contact.Email(), contact.Count)
+		}
+		return nil
+
+	case command == "import" && len(args) == 1:
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		added, err := book.ImportVCard(r)
+		if err != nil {
+			return err
+		}
+		if err := book.Save(); err != nil {
+			return fmt.Errorf("saving contacts: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d addresses to %s\n", added, cfg.ContactsPath)
+		return nil
+
+	case command == "export" && len(args) <= 1:
+		if len(args) == 0 || args[0] == "-" {
+			return book.ExportVCard(os.Stdout)
+		}
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		if err := book.ExportVCard(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return errors.New("usage: jkm contacts [list | import <file.vcf> | export [file.vcf]]")
+}
@@ -22,6 +22,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "contacts" {
+		if err := runContacts(cfg, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	app, err := router.New(cfg)
 	if err != nil {
 		msg := fmt.Sprintf("creating router: %v", err)
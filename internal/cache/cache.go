@@ -0,0 +1,350 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Keeping the messages we've read in memory, so that reading one again doesn't go back to the server.
+// Messages are kept most recently read first, and the least recently read are dropped
+// once there are more of them, or more bytes of them, than the limits allow.
+// Messages are known by their mailbox and UID, so moving one out of its mailbox forgets it.
+//
+// Messages can also be fetched before they're read, e.g. those around the list's cursor.
+// Prefetching goes one message at a time and waits while anything is being read,
+// so that it never keeps the user waiting for more than one message.
+
+// How long to wait before prefetching each message, so that a cursor moving on stops prefetching before it starts.
+const prefetchDelay = 250 * time.Millisecond
+
+// key identifies a message by the mailbox it's in and its UID there.
+type key struct {
+	mailbox string
+	id      int
+}
+
+// entry is a kept message, with its size counted once.
+type entry struct {
+	key     key
+	message email.Message
+	size    int
+}
+
+// Receiver is an email.Receiver which keeps the messages it reads, up to a limit.
+// Everything but reading passes straight through to the receiver it wraps.
+type Receiver struct {
+	email.Receiver
+
+	// The most bytes and the most messages kept at once.
+	maxBytes, maxMessages int
+
+	mu sync.Mutex
+
+	// The kept messages, most recently read first, and the element holding each.
+	order   *list.List
+	entries map[key]*list.Element
+
+	// How many bytes of messages are kept.
+	bytes int
+
+	// How many reads were answered from what was kept, and how many went to the receiver.
+	hits, misses int
+
+	// How many reads are waiting on the receiver, which prefetching gives way to.
+	reading int
+
+	// Stops the prefetching under way, if any.
+	cancelPrefetch context.CancelFunc
+}
+
+// New wraps a receiver to keep up to maxBytes of, and maxMessages, messages.
+// A limit of zero or less keeps nothing.
+func New(receiver email.Receiver, maxBytes, maxMessages int) *Receiver {
+	return &Receiver{
+		Receiver:    receiver,
+		maxBytes:    maxBytes,
+		maxMessages: maxMessages,
+		order:       list.New(),
+		entries:     map[key]*list.Element{},
+	}
+}
+
+// Read a message from the selected mailbox, from memory if it was read before.
+func (r *Receiver) Read(id int) (*email.Message, error) {
+	k := key{mailbox: r.Selected(), id: id}
+
+	r.mu.Lock()
+	if elem, ok := r.entries[k]; ok {
+		r.order.MoveToFront(elem)
+		r.hits++
+		msg := elem.Value.(*entry).message
+		log.Debugf("cache: hit for %d in %s (%s)", id, k.mailbox, r.stats())
+		r.mu.Unlock()
+		return &msg, nil
+	}
+	r.misses++
+	r.reading++
+	log.Debugf("cache: miss for %d in %s (%s)", id, k.mailbox, r.stats())
+	r.mu.Unlock()
+
+	msg, err := r.Receiver.Read(id)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reading--
+	if err != nil || msg == nil {
+		return msg, err
+	}
+	r.add(k, *msg)
+	return msg, nil
+}
+
+// Prefetch the messages in the selected mailbox with the given IDs, in order, stopping any prefetching under way.
+func (r *Receiver) Prefetch(ids []int) {
+	mailbox := r.Selected()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelPrefetch != nil {
+		r.cancelPrefetch()
+	}
+	r.cancelPrefetch = cancel
+	if r.maxMessages <= 0 {
+		return
+	}
+	wanted := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := r.entries[key{mailbox: mailbox, id: id}]; !ok {
+			wanted = append(wanted, id)
+		}
+	}
+	if len(wanted) > 0 {
+		go r.prefetch(ctx, mailbox, wanted)
+	}
+}
+
+// Fetch and keep messages from the mailbox until they're all kept, or we're stopped.
+func (r *Receiver) prefetch(ctx context.Context, mailbox string, ids []int) {
+	fetched := 0
+	for _, id := range ids {
+		// The IDs only mean anything in the mailbox they were listed in.
+		if !r.waitToPrefetch(ctx) || r.Selected() != mailbox {
+			break
+		}
+		k := key{mailbox: mailbox, id: id}
+		r.mu.Lock()
+		_, ok := r.entries[k]
+		r.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		msg, err := r.Receiver.Read(id)
+		if err != nil {
+			log.Debugf("cache: stopped prefetching in %s: %v", mailbox, err)
+			break
+		}
+		if msg == nil || r.Selected() != mailbox {
+			break
+		}
+		r.mu.Lock()
+		if _, ok := r.entries[k]; !ok {
+			r.add(k, *msg)
+		}
+		r.mu.Unlock()
+		fetched++
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	log.Debugf("cache: prefetched %d of %d messages in %s (%s)", fetched, len(ids), mailbox, r.stats())
+}
+
+// Wait a moment, and then for any reads to finish, reporting whether to go on prefetching.
+func (r *Receiver) waitToPrefetch(ctx context.Context) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(prefetchDelay):
+		}
+		r.mu.Lock()
+		isReading := r.reading > 0
+		r.mu.Unlock()
+		if !isReading {
+			return true
+		}
+	}
+}
+
+// Stop prefetching.
+func (r *Receiver) stopPrefetching() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelPrefetch != nil {
+		r.cancelPrefetch()
+		r.cancelPrefetch = nil
+	}
+}
+
+// List the selected mailbox, bringing the kept messages' flags up to date with it.
+func (r *Receiver) List(shouldBustCache bool) ([]email.MessageHeader, error) {
+	headers, err := r.Receiver.List(shouldBustCache)
+	if err != nil {
+		return headers, err
+	}
+	mailbox := r.Selected()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, header := range headers {
+		elem, ok := r.entries[key{mailbox: mailbox, id: header.ID}]
+		if !ok {
+			continue
+		}
+		kept := elem.Value.(*entry)
+		// A different message under the same UID means the mailbox's UIDs were reset.
+		if kept.message.MessageID != header.MessageID {
+			r.remove(elem)
+			continue
+		}
+		kept.message.Flags = header.Flags
+	}
+	return headers, nil
+}
+
+// Set or clear a flag on a message, and on the kept copy of it.
+func (r *Receiver) SetFlag(id int, flag email.Flag, on bool) error {
+	k := key{mailbox: r.Selected(), id: id}
+	if err := r.Receiver.SetFlag(id, flag, on); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.entries[k]; ok {
+		kept := elem.Value.(*entry)
+		kept.message.Flags = kept.message.Flags.With(flag, on)
+	}
+	return nil
+}
+
+// Delete a message, forgetting it.
+func (r *Receiver) Delete(id int) error {
+	r.forget(id)
+	return r.Receiver.Delete(id)
+}
+
+// Archive a message, forgetting it.
+func (r *Receiver) Archive(id int) error {
+	r.forget(id)
+	return r.Receiver.Archive(id)
+}
+
+// Move a message to another mailbox, forgetting it.
+func (r *Receiver) Move(id int, mailbox string) error {
+	r.forget(id)
+	return r.Receiver.Move(id, mailbox)
+}
+
+// Forget a message in the selected mailbox.
+func (r *Receiver) forget(id int) {
+	k := key{mailbox: r.Selected(), id: id}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.entries[k]; ok {
+		r.remove(elem)
+	}
+}
+
+// Keep a message, dropping the least recently read until it fits.
+// Expects the lock to be held.
+func (r *Receiver) add(k key, msg email.Message) {
+	if elem, ok := r.entries[k]; ok {
+		r.remove(elem)
+	}
+	size := sizeOf(msg)
+	if r.maxMessages <= 0 || size > r.maxBytes {
+		return
+	}
+	r.entries[k] = r.order.PushFront(&entry{key: k, message: msg, size: size})
+	r.bytes += size
+	for r.order.Len() > r.maxMessages || r.bytes > r.maxBytes {
+		r.remove(r.order.Back())
+	}
+}
+
+// Drop a kept message.
+// Expects the lock to be held.
+func (r *Receiver) remove(elem *list.Element) {
+	kept := r.order.Remove(elem).(*entry)
+	delete(r.entries, kept.key)
+	r.bytes -= kept.size
+}
+
+// A summary of how the cache is doing, for the logs.
+// Expects the lock to be held.
+func (r *Receiver) stats() string {
+	return fmt.Sprintf("%d hits, %d misses, %d messages, %d bytes", r.hits, r.misses, r.order.Len(), r.bytes)
+}
+
+// Roughly how many bytes a message takes up: its text, which dwarfs the rest.
+func sizeOf(msg email.Message) int {
+	size := len(msg.Subject) + len(msg.Body)
+	for _, part := range msg.Parts {
+		size += len(part.Content)
+	}
+	return size
+}
+
+// Client is an email.Client whose receiving goes through a Receiver, so that it keeps the messages it reads.
+type Client struct {
+	email.Client
+	receiver *Receiver
+}
+
+// NewClient wraps a client to keep up to maxBytes of, and maxMessages, messages.
+func NewClient(client email.Client, maxBytes, maxMessages int) *Client {
+	return &Client{Client: client, receiver: New(client, maxBytes, maxMessages)}
+}
+
+func (c *Client) Read(id int) (*email.Message, error) {
+	return c.receiver.Read(id)
+}
+
+func (c *Client) List(shouldBustCache bool) ([]email.MessageHeader, error) {
+	return c.receiver.List(shouldBustCache)
+}
+
+func (c *Client) SetFlag(id int, flag email.Flag, on bool) error {
+	return c.receiver.SetFlag(id, flag, on)
+}
+
+func (c *Client) Delete(id int) error {
+	return c.receiver.Delete(id)
+}
+
+func (c *Client) Archive(id int) error {
+	return c.receiver.Archive(id)
+}
+
+func (c *Client) Move(id int, mailbox string) error {
+	return c.receiver.Move(id, mailbox)
+}
+
+func (c *Client) Prefetch(ids []int) {
+	c.receiver.Prefetch(ids)
+}
+
+// Disconnect, stopping any prefetching first.
+func (c *Client) Disconnect() error {
+	c.receiver.stopPrefetching()
+	return c.Client.Disconnect()
+}
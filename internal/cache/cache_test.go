@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// A receiver with a few messages in its inbox, which counts how often each is read.
+type countingReceiver struct {
+	email.Receiver
+	mu     sync.Mutex
+	bodies map[int]string
+	reads  map[int]int
+}
+
+func newCountingReceiver(bodies map[int]string) *countingReceiver {
+	return &countingReceiver{bodies: bodies, reads: map[int]int{}}
+}
+
+func (r *countingReceiver) Selected() string { return email.Inbox }
+
+func (r *countingReceiver) Read(id int) (*email.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reads[id]++
+	return &email.Message{MessageHeader: email.MessageHeader{ID: id}, Body: r.bodies[id]}, nil
+}
+
+// How many times a message has been read.
+func (r *countingReceiver) readsOf(id int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reads[id]
+}
+
+func (r *countingReceiver) Delete(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.bodies, id)
+	return nil
+}
+
+func (r *countingReceiver) SetFlag(id int, flag email.Flag, on bool) error { return nil }
+
+func readAll(t *testing.T, r *Receiver, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := r.Read(id); err != nil {
+			t.Fatalf("Failed to read %d: %v", id, err)
+		}
+	}
+}
+
+// Whether a message in the inbox is kept.
+func isKept(r *Receiver, id int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.entries[key{mailbox: email.Inbox, id: id}]
+	return ok
+}
+
+func TestReadKeepsMessages(t *testing.T) {
+	log.Init(false)
+	inner := newCountingReceiver(map[int]string{1: "one", 2: "two", 3: "three"})
+	r := New(inner, 1<<20, 2)
+
+	readAll(t, r, 1, 2, 1, 3, 1, 2)
+	// 3 pushed out 2, the least recently read, and then 2 pushed out 3.
+	if inner.reads[1] != 1 || inner.reads[2] != 2 || inner.reads[3] != 1 {
+		t.Errorf("Expected 1, 2 and 1 reads, got %v", inner.reads)
+	}
+	if r.hits != 2 || r.misses != 4 {
+		t.Errorf("Expected 2 hits and 4 misses, got %d and %d", r.hits, r.misses)
+	}
+}
+
+func TestReadLimitsBytes(t *testing.T) {
+	log.Init(false)
+	inner := newCountingReceiver(map[int]string{1: strings.Repeat("a", 60), 2: strings.Repeat("b", 60), 3: strings.Repeat("c", 200)})
+	r := New(inner, 100, 10)
+
+	readAll(t, r, 1, 2, 3, 2, 3)
+	// 2 doesn't fit beside 1, and 3 doesn't fit at all.
+	if inner.reads[2] != 1 || inner.reads[3] != 2 {
+		t.Errorf("Expected 1 and 2 reads, got %v", inner.reads)
+	}
+	if r.bytes != 60 || r.order.Len() != 1 {
+		t.Errorf("Expected 1 message of 60 bytes kept, got %d of %d bytes", r.order.Len(), r.bytes)
+	}
+}
+
+func TestChangesReachKeptMessages(t *testing.T) {
+	log.Init(false)
+	inner := newCountingReceiver(map[int]string{1: "one", 2: "two"})
+	r := New(inner, 1<<20, 10)
+	readAll(t, r, 1, 2)
+
+	if err := r.SetFlag(1, email.Flagged, true); err != nil {
+		t.Fatalf("Failed to set flag: %v", err)
+	}
+	msg, err := r.Read(1)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !msg.Flags.Has(email.Flagged) {
+		t.Error("Expected the kept message to be flagged")
+	}
+
+	if err := r.Delete(2); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	readAll(t, r, 2)
+	if inner.reads[2] != 2 {
+		t.Errorf("Expected a deleted message to be read afresh, got %d reads", inner.reads[2])
+	}
+}
+
+func TestZeroLimitKeepsNothing(t *testing.T) {
+	log.Init(false)
+	inner := newCountingReceiver(map[int]string{1: "one"})
+	r := New(inner, 1<<20, 0)
+
+	readAll(t, r, 1, 1)
+	if inner.reads[1] != 2 {
+		t.Errorf("Expected 2 reads, got %d", inner.reads[1])
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	log.Init(false)
+	inner := newCountingReceiver(map[int]string{1: "one", 2: "two", 3: "three"})
+	r := New(inner, 1<<20, 10)
+
+	// Moving on straight away stops the first prefetch before it fetches anything.
+	r.Prefetch([]int{1})
+	r.Prefetch([]int{2, 3})
+	deadline := time.Now().Add(5 * time.Second)
+	for !isKept(r, 3) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the prefetch")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.stopPrefetching()
+
+	readAll(t, r, 2, 3)
+	if inner.readsOf(1) != 0 || inner.readsOf(2) != 1 || inner.readsOf(3) != 1 {
+		t.Errorf("Expected 0, 1 and 1 reads, got %v", inner.reads)
+	}
+}
@@ -0,0 +1,114 @@
+package chooser
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/bubbles/list"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jcc333/jkm/internal/commands"
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/messages"
+)
+
+// Our mailbox chooser.
+// This component asks the user which mailbox to move a message to.
+// It is embedded in the views which can move messages: they forward it messages while it is open,
+// and check whether a mailbox was chosen or the choice abandoned after each update.
+
+// The model for choosing a mailbox.
+type Model struct {
+	// The underlying list of mailboxes.
+	list list.Model
+
+	// Email client for listing the mailboxes.
+	receiver email.Receiver
+
+	// The name of the chosen mailbox, once there is one.
+	Chosen string
+
+	// Whether the user gave up on choosing.
+	IsCancelled bool
+}
+
+// A list item for the chooser.
+type mailboxItem struct {
+	mailbox email.Mailbox
+}
+
+// A list-item's title.
+func (i mailboxItem) Title() string {
+	return strings.Repeat("  ", i.mailbox.Depth()) + i.mailbox.Leaf()
+}
+
+// A list-item's description.
+func (i mailboxItem) Description() string {
+	return i.mailbox.Name
+}
+
+// A list-item's search value.
+func (i mailboxItem) FilterValue() string {
+	return i.mailbox.Name
+}
+
+// Make a new chooser with the given title, e.g. "Move to...".
+func New(receiver email.Receiver, title string) Model {
+	listModel := list.New([]list.Item{}, list.NewDefaultDelegate(), 0, 0)
+	listModel.Title = title
+	listModel.SetShowHelp(false)
+	listModel.SetFilteringEnabled(true)
+	return Model{
+		list:     listModel,
+		receiver: receiver,
+	}
+}
+
+// Fetch the mailboxes to choose from.
+func (m Model) Init() tea.Cmd {
+	return tea.Batch(commands.FetchMailboxes(m.receiver), tea.WindowSize())
+}
+
+// Handle the list of mailboxes arriving, and keys for choosing one.
+func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.list.SetSize(msg.Width, msg.Height)
+		return m, nil
+
+	case messages.FetchedMailboxes:
+		items := []list.Item{}
+		for _, mailbox := range msg.Mailboxes {
+			if mailbox.Selectable() && mailbox.Name != msg.Selected {
+				items = append(items, mailboxItem{mailbox: mailbox})
+			}
+		}
+		return m, m.list.SetItems(items)
+
+	case tea.KeyMsg:
+		if m.list.FilterState() == list.Filtering {
+			break
+		}
+		switch msg.String() {
+		case "esc", "q":
+			// Escape clears a filter before it cancels.
+			if m.list.FilterState() == list.FilterApplied {
+				break
+			}
+			m.IsCancelled = true
+			return m, nil
+		case "enter":
+			if item, ok := m.list.SelectedItem().(mailboxItem); ok {
+				m.Chosen = item.mailbox.Name
+			}
+			return m, nil
+		}
+	}
+
+	var cmd tea.Cmd
+	m.list, cmd = m.list.Update(msg)
+	return m, cmd
+}
+
+// Render the chooser.
+func (m Model) View() string {
+	return m.list.View()
+}
@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/messages"
+)
+
+// SaveAttachments fetches a message's attachments and writes them into dir.
+// Existing files are never overwritten; a numbered name is picked instead.
+func SaveAttachments(receiver email.Receiver, id int, attachments []email.Attachment, dir string) tea.Cmd {
+	log.Info("save attachments command")
+
+	return func() tea.Msg {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return messages.Err{Error: fmt.Errorf("creating download directory: %w", err)}
+		}
+
+		paths := make([]string, 0, len(attachments))
+		for _, attachment := range attachments {
+			content, err := receiver.ReadAttachment(id, attachment)
+			if err != nil {
+				return messages.Err{Error: err}
+			}
+			path, err := writeNewFile(dir, attachmentName(attachment), content)
+			if err != nil {
+				return messages.Err{Error: fmt.Errorf("saving attachment: %w", err)}
+			}
+			log.Infof("saved attachment %s to %s", attachment.PartID, path)
+			paths = append(paths, path)
+		}
+		return messages.SavedAttachments{Paths: paths}
+	}
+}
+
+// ResumeDraft composes a draft from the drafts mailbox, to finish writing it.
+// Its attachments are fetched into a temporary directory, so that they can be sent from there.
+func ResumeDraft(receiver email.Receiver, draft email.Message) tea.Cmd {
+	log.Info("resume draft command")
+
+	return func() tea.Msg {
+		if len(draft.Attachments) > 0 {
+			dir, err := os.MkdirTemp("", "jkm-draft-")
+			if err != nil {
+				return messages.Err{Error: fmt.Errorf("creating directory for draft attachments: %w", err)}
+			}
+			attachments := make([]email.Attachment, len(draft.Attachments))
+			for i, attachment := range draft.Attachments {
+				content, err := receiver.ReadAttachment(draft.ID, attachment)
+				if err != nil {
+					return messages.Err{Error: err}
+				}
+				path, err := writeNewFile(dir, attachmentName(attachment), content)
+				if err != nil {
+					return messages.Err{Error: fmt.Errorf("saving draft attachment: %w", err)}
+				}
+				attachment.Path = path
+				attachment.Size = len(content)
+				attachments[i] = attachment
+			}
+			draft.Attachments = attachments
+		}
+		log.Infof("resuming draft %s", draft.MessageID)
+		return messages.ComposeMessage{Draft: draft}
+	}
+}
+
+// A safe file name for an attachment.
+// The sender picks the name, so anything resembling a path is stripped from it.
+func attachmentName(attachment email.Attachment) string {
+	name := filepath.Base(strings.ReplaceAll(attachment.Filename, "\\", "/"))
+	if name == "." || name == "/" || name == ".." || name == "" {
+		name = fmt.Sprintf("attachment-%s", attachment.PartID)
+	}
+	return name
+}
+
+// Write content to a file named like name in dir, numbering the name if it is taken.
+func writeNewFile(dir, name string, content []byte) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for n := 0; ; n++ {
+		candidate := name
+		if n > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if _, err := file.Write(content); err != nil {
+			file.Close()
+			return "", err
+		}
+		return path, file.Close()
+	}
+}
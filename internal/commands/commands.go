@@ -1,9 +1,8 @@
 package commands
 
 import (
-	"time"
-
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jcc333/jkm/internal/contacts"
 	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/log"
 	"github.com/jcc333/jkm/internal/messages"
@@ -13,6 +12,15 @@ import (
 // These live in their own package versus by-model to avoid implementation-drift,
 // commands being application-wide.
 
+// The message for a command which failed: Offline if it was for want of a connection, or else Err.
+func failed(err error) tea.Msg {
+	if email.IsOffline(err) {
+		log.Warnf("offline: %v", err)
+		return messages.Offline{Error: err}
+	}
+	return messages.Err{Error: err}
+}
+
 // ListView displays the list of messages.
 func ListView() tea.Cmd {
 	log.Info("list view command")
@@ -33,6 +41,16 @@ func ComposeView() tea.Cmd {
 	}
 }
 
+// ComposeDraft displays the compose message view, starting from a draft such as a reply.
+func ComposeDraft(draft email.Message) tea.Cmd {
+	log.Info("compose draft command")
+
+	return func() tea.Msg {
+		log.Info("compose draft message")
+		return messages.ComposeMessage{Draft: draft}
+	}
+}
+
 // ReadEmail displays the message details.
 func ReadEmail(header email.MessageHeader) tea.Cmd {
 	log.Info("read email command")
@@ -44,16 +62,12 @@ func ReadEmail(header email.MessageHeader) tea.Cmd {
 }
 
 // SendEmail initiates the message sending process
-func SendEmail(recipient, subject, body string) tea.Cmd {
+func SendEmail(msg email.Message) tea.Cmd {
 	log.Info("send email command")
 
 	return func() tea.Msg {
 		log.Info("send email message")
-		return messages.SendingEmail{
-			Recipient: recipient,
-			Subject:   subject,
-			Body:      body,
-		}
+		return messages.SendingEmail{Message: msg}
 	}
 }
 
@@ -63,11 +77,30 @@ func SendingEmail(msg messages.SendEmail) tea.Cmd {
 
 	return func() tea.Msg {
 		log.Info("sending email")
-		return messages.SendingEmail{
-			Recipient: msg.Recipient,
-			Subject:   msg.Subject,
-			Body:      msg.Body,
+		return messages.SendingEmail{Message: msg.Message}
+	}
+}
+
+// SaveDraft asks to keep an unfinished message as a draft.
+func SaveDraft(msg email.Message) tea.Cmd {
+	log.Info("save draft command")
+
+	return func() tea.Msg {
+		log.Info("save draft message")
+		return messages.SaveDraft{Message: msg}
+	}
+}
+
+// StoreDraft saves a draft to the drafts mailbox.
+func StoreDraft(drafter email.Drafter, msg email.Message) tea.Cmd {
+	log.Info("store draft command")
+
+	return func() tea.Msg {
+		if err := drafter.SaveDraft(msg); err != nil {
+			return messages.Err{Error: err}
 		}
+		log.Infof("saved draft %s", msg.MessageID)
+		return messages.SavedDraft{}
 	}
 }
 
@@ -80,13 +113,27 @@ func SentMessage() tea.Cmd {
 	}
 }
 
-// A tick loop for updating our email listings.
-func Tick() tea.Cmd {
-	log.Info("tick command")
-	return tea.Tick(time.Second*3, func(t time.Time) tea.Msg {
-		log.Info("tick")
-		return messages.Tick(t)
-	})
+// Wait for the server to push the next mailbox update.
+// The caller re-issues this after handling each update to keep listening.
+func WaitForUpdate(watcher email.Watcher) tea.Cmd {
+	log.Info("wait for update command")
+
+	return func() tea.Msg {
+		if watcher == nil {
+			return nil
+		}
+		update, ok := <-watcher.Updates()
+		if !ok {
+			log.Info("updates closed")
+			return nil
+		}
+		if changed, ok := update.(email.ConnectionChanged); ok {
+			log.Infof("connection %s", changed.State)
+			return messages.ConnectionChanged{ConnectionChanged: changed}
+		}
+		log.Info("mailbox updated")
+		return messages.MailboxUpdated{Update: update}
+	}
 }
 
 // ShowError displays an error message
@@ -99,18 +146,54 @@ func ShowError(err error) tea.Cmd {
 	}
 }
 
-// Fetch the message body for a message header
+// Fetch the full message for a message header
 func FetchEmailBody(id int, receiver email.Receiver) tea.Cmd {
 	log.Info("fetch email body command")
 
 	return func() tea.Msg {
-		body, err := receiver.Read(id)
+		msg, err := receiver.Read(id)
 		if err != nil {
 			log.Errorf("error fetching body: %v", err)
-			return messages.Err{Error: err}
+			return failed(err)
 		}
 		log.Info("fetched body message")
-		return messages.FetchedBody{ID: id, Body: body.Body}
+		return messages.FetchedOne{Message: msg}
+	}
+}
+
+// HarvestContacts remembers who a message we read was from and to, so that they're suggested as recipients.
+func HarvestContacts(book *contacts.Book, msg *email.Message) tea.Cmd {
+	return func() tea.Msg {
+		book.HarvestRead(msg)
+		if err := book.Save(); err != nil {
+			log.Warnf("error saving contacts: %v", err)
+		}
+		return nil
+	}
+}
+
+// Prefetch fetches messages in the background, so that opening them is instant.
+func Prefetch(prefetcher email.Prefetcher, ids []int) tea.Cmd {
+	log.Info("prefetch command")
+
+	return func() tea.Msg {
+		prefetcher.Prefetch(ids)
+		log.Infof("prefetching %d emails", len(ids))
+		return nil
+	}
+}
+
+// FetchSource fetches the whole of a message as it was sent, to show its source.
+func FetchSource(receiver email.Receiver, id int) tea.Cmd {
+	log.Info("fetch source command")
+
+	return func() tea.Msg {
+		source, err := receiver.Source(id)
+		if err != nil {
+			return failed(err)
+		}
+		log.Info("fetched source message")
+		return messages.FetchedSource{ID: id, Source: string(source)}
 	}
 }
 
@@ -126,7 +209,7 @@ func RefreshEmails(receiver email.Receiver, shouldBustCache bool) tea.Cmd {
 		}
 		headers, err := receiver.List(shouldBustCache)
 		if err != nil {
-			return messages.Err{Error: err}
+			return failed(err)
 		}
 
 		items := make([]*email.MessageHeader, len(headers))
@@ -139,3 +222,171 @@ func RefreshEmails(receiver email.Receiver, shouldBustCache bool) tea.Cmd {
 		return messages.RefreshedEmails{Items: items}
 	}
 }
+
+// LoadCachedEmails lists the messages as last seen, to show while the list is refreshed from the server.
+func LoadCachedEmails(receiver email.Receiver) tea.Cmd {
+	log.Info("load cached emails command")
+
+	return func() tea.Msg {
+		if receiver == nil {
+			return nil
+		}
+		headers := receiver.Cached()
+		if len(headers) == 0 {
+			return nil
+		}
+
+		items := make([]*email.MessageHeader, len(headers))
+		for i, header := range headers {
+			headerCopy := header
+			items[i] = &headerCopy
+		}
+		log.Infof("loaded %d cached emails", len(items))
+		return messages.RefreshedEmails{Items: items}
+	}
+}
+
+// SearchEmails searches the selected mailbox with a query, such as `from:alice is:unread`.
+func SearchEmails(receiver email.Receiver, text string) tea.Cmd {
+	log.Info("search emails command")
+
+	return func() tea.Msg {
+		if receiver == nil {
+			return nil
+		}
+		query, err := email.ParseQuery(text)
+		if err != nil {
+			return messages.Err{Error: err}
+		}
+		headers, err := receiver.Search(query)
+		if err != nil {
+			return failed(err)
+		}
+
+		items := make([]*email.MessageHeader, len(headers))
+		for i, header := range headers {
+			headerCopy := header
+			items[i] = &headerCopy
+		}
+		log.Infof("searched emails, found %d", len(items))
+		return messages.SearchedEmails{Query: text, Items: items}
+	}
+}
+
+// ClearSearch leaves search results for the mailbox.
+func ClearSearch() tea.Cmd {
+	log.Info("clear search command")
+
+	return func() tea.Msg {
+		return messages.ClearedSearch{}
+	}
+}
+
+// FetchThreads groups the listed messages into conversations.
+func FetchThreads(receiver email.Receiver) tea.Cmd {
+	log.Info("fetch threads command")
+
+	return func() tea.Msg {
+		if receiver == nil {
+			return nil
+		}
+		threads, err := receiver.Threads()
+		if err != nil {
+			return failed(err)
+		}
+		log.Info("fetched threads")
+		return messages.FetchedThreads{Threads: threads}
+	}
+}
+
+// FetchMailboxes lists the mailboxes on the server.
+func FetchMailboxes(receiver email.Receiver) tea.Cmd {
+	log.Info("fetch mailboxes command")
+
+	return func() tea.Msg {
+		if receiver == nil {
+			return nil
+		}
+		mailboxes, err := receiver.Mailboxes()
+		if err != nil {
+			return failed(err)
+		}
+		log.Info("fetched mailboxes")
+		return messages.FetchedMailboxes{Mailboxes: mailboxes, Selected: receiver.Selected()}
+	}
+}
+
+// SelectMailbox asks to work in another mailbox.
+func SelectMailbox(name string) tea.Cmd {
+	log.Info("select mailbox command")
+
+	return func() tea.Msg {
+		log.Info("select mailbox message")
+		return messages.SelectMailbox{Name: name}
+	}
+}
+
+// ChangeMailbox switches the mail layer over to another mailbox.
+func ChangeMailbox(receiver email.Receiver, name string) tea.Cmd {
+	log.Info("change mailbox command")
+
+	return func() tea.Msg {
+		if err := receiver.Select(name); err != nil {
+			return failed(err)
+		}
+		log.Infof("changed mailbox to %s", name)
+		return messages.SelectedMailbox{Name: name}
+	}
+}
+
+// SetFlag sets or clears a flag on a message, e.g. to mark it read or star it.
+func SetFlag(receiver email.Receiver, id int, flag email.Flag, on bool) tea.Cmd {
+	log.Info("set flag command")
+
+	return func() tea.Msg {
+		if err := receiver.SetFlag(id, flag, on); err != nil {
+			return failed(err)
+		}
+		log.Infof("set flag %d to %v on %d", flag, on, id)
+		return messages.FlagSet{ID: id, Flag: flag, On: on}
+	}
+}
+
+// DeleteEmail moves a message to the trash.
+func DeleteEmail(receiver email.Receiver, id int) tea.Cmd {
+	log.Info("delete email command")
+
+	return func() tea.Msg {
+		if err := receiver.Delete(id); err != nil {
+			return failed(err)
+		}
+		log.Infof("deleted email %d", id)
+		return messages.RemovedEmail{ID: id}
+	}
+}
+
+// ArchiveEmail moves a message to the archive.
+func ArchiveEmail(receiver email.Receiver, id int) tea.Cmd {
+	log.Info("archive email command")
+
+	return func() tea.Msg {
+		if err := receiver.Archive(id); err != nil {
+			return failed(err)
+		}
+		log.Infof("archived email %d", id)
+		return messages.RemovedEmail{ID: id}
+	}
+}
+
+// MoveEmail moves a message to another mailbox.
+func MoveEmail(receiver email.Receiver, id int, mailbox string) tea.Cmd {
+	log.Info("move email command")
+
+	return func() tea.Msg {
+		if err := receiver.Move(id, mailbox); err != nil {
+			return failed(err)
+		}
+		log.Infof("moved email %d to %s", id, mailbox)
+		return messages.RemovedEmail{ID: id}
+	}
+}
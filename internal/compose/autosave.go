@@ -0,0 +1,96 @@
+package compose
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Keeping the message being composed on disk as it's written, so that a crash doesn't lose it.
+// The file is forgotten once the message is sent, saved as a draft or discarded,
+// so one left behind belongs to a composition which never finished, and is picked up by the next.
+
+// How often the message being composed is written to disk.
+const autosaveInterval = 10 * time.Second
+
+// autosaveMsg is sent when it's time to autosave the composition with the given Message-ID.
+type autosaveMsg struct {
+	messageID string
+}
+
+// Schedule the next autosave.
+func (m *model) scheduleAutosave() tea.Cmd {
+	if m.cfg.AutosavePath == "" {
+		return nil
+	}
+	messageID := m.messageID
+	return tea.Tick(autosaveInterval, func(time.Time) tea.Msg {
+		return autosaveMsg{messageID: messageID}
+	})
+}
+
+// Write the message to disk, if there's anything new to write.
+func (m *model) autosave() {
+	msg := m.message()
+	if msg.IsBlank() {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil || bytes.Equal(data, m.autosaved) {
+		return
+	}
+	path := m.cfg.AutosavePath
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Warnf("compose: failed to autosave: %v", err)
+		return
+	}
+	// Written aside and renamed into place, so that a crash mid-write can't lose the last save.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Warnf("compose: failed to autosave: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Warnf("compose: failed to autosave: %v", err)
+		return
+	}
+	m.autosaved = data
+	log.Debug("compose: autosaved")
+}
+
+// The message a composition which never finished was writing, or nil if there isn't one.
+func recoverAutosave(cfg *configure.Config) (*email.Message, error) {
+	if cfg.AutosavePath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.AutosavePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg email.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ForgetAutosave removes the autosaved message, once it's been sent, saved as a draft or discarded.
+func ForgetAutosave(cfg *configure.Config) {
+	if cfg.AutosavePath == "" {
+		return
+	}
+	if err := os.Remove(cfg.AutosavePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("compose: failed to remove autosaved message: %v", err)
+	}
+}
@@ -1,79 +1,386 @@
 package compose
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/charmbracelet/bubbles/filepicker"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/dustin/go-humanize"
 	"github.com/jcc333/jkm/internal/commands"
 	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/contacts"
+	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/log"
 	"github.com/jcc333/jkm/internal/messages"
 )
 
 // Our model for composing emails.
-// This is a pretty trivial huh form view.
+// This is a pretty trivial huh form view, plus a file picker for attachments.
 
-// Our composing model has 3 fields (recipient, subject, body)
+// Our composing model has 5 fields (recipient, cc, bcc, subject, body)
 // This type enumerates them to make focus easier.
 type field int
 
 const (
 	recipient field = iota
+	cc
+	bcc
 	subject
 	body
 )
 
 // Our composing model.
-// Has text inputs for the subject, recipient, and body.
+// Has text inputs for the recipients, subject, and body.
 // Has a pointer to the global config.
 // Has a pointer to the field being edited.
 type model struct {
 	// The global configuration.
 	cfg *configure.Config
 
+	// The address book recipients are suggested from, if there is one.
+	book *contacts.Book
+
 	// The form for composing our email.
 	form *huh.Form
 
 	// The recipient(s), subject, and body of the email
 	recipient, subject, body string
 
+	// Who's copied in on the email, openly and blindly.
+	cc, bcc string
+
 	// Whether the email has been confirmed for sending.
 	isConfirmed bool
+
+	// The files to attach.
+	attachments []email.Attachment
+
+	// Picks files to attach.
+	picker filepicker.Model
+
+	// Whether the file picker is showing, instead of the form.
+	isPicking bool
+
+	// Why the last file couldn't be attached, if it couldn't.
+	attachErr error
+
+	// The threading headers of a reply, which the user doesn't edit.
+	inReplyTo  string
+	references []string
+
+	// The message's Message-ID, which every save of it as a draft shares.
+	messageID string
+
+	// The message's flags, which mark a draft resumed from the drafts mailbox.
+	flags email.Flag
+
+	// What was last autosaved, so that an unchanged message isn't written again.
+	autosaved []byte
+
+	// Whether the message was recovered from a composition which never finished.
+	isRecovered bool
+
+	// Whether we're asking whether to save the message as a draft before leaving.
+	isLeaving bool
 }
 
-// Construct a new composing model.
-func New(cfg *configure.Config) *model {
+// How many contacts are suggested for the recipient being typed.
+const suggestionLimit = 5
+
+var (
+	attachmentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
+	helpStyle       = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
+	errStyle        = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+	promptStyle     = lipgloss.NewStyle().Bold(true)
+	chipStyle       = lipgloss.NewStyle().Background(lipgloss.Color("237")).Foreground(lipgloss.Color("252")).Padding(0, 1)
+)
+
+// Construct a new composing model, prefilled from the draft, suggesting recipients from the book.
+// A blank draft composes a new message; replies and forwards come from the email package.
+// A blank draft also picks up a message which was being written when jkm last stopped without finishing it.
+func New(cfg *configure.Config, draft email.Message, book *contacts.Book) *model {
 	log.Info("compose: initializing compose model")
 
-	var m model
-	form := huh.NewForm(
+	isRecovered := false
+	if draft.IsBlank() {
+		recovered, err := recoverAutosave(cfg)
+		if err != nil {
+			log.Warnf("compose: failed to recover autosaved message: %v", err)
+		} else if recovered != nil {
+			log.Info("compose: recovered autosaved message")
+			draft, isRecovered = *recovered, true
+		}
+	}
+	if draft.MessageID == "" {
+		draft.MessageID = email.NewMessageID(cfg.EmailAddress)
+	}
+
+	m := model{
+		cfg:         cfg,
+		book:        book,
+		recipient:   email.FormatAddresses(draft.To),
+		cc:          email.FormatAddresses(draft.Cc),
+		bcc:         email.FormatAddresses(draft.Bcc),
+		subject:     draft.Subject,
+		body:        draft.Body,
+		attachments: draft.Attachments,
+		inReplyTo:   draft.InReplyTo,
+		references:  draft.References,
+		messageID:   draft.MessageID,
+		flags:       draft.Flags,
+		isRecovered: isRecovered,
+	}
+	m.form = m.newForm()
+
+	m.picker = filepicker.New()
+	m.picker.ShowPermissions = false
+	// Escape cancels picking rather than going up a directory.
+	m.picker.KeyMap.Back.SetKeys("h", "backspace", "left")
+	if home, err := os.UserHomeDir(); err == nil {
+		m.picker.CurrentDirectory = home
+	}
+	return &m
+}
+
+// The form for composing the message, bound to the model's fields.
+func (m *model) newForm() *huh.Form {
+	// Tab completes a suggested recipient where there is one; see Update.
+	keymap := huh.NewDefaultKeyMap()
+	keymap.Input.AcceptSuggestion.SetHelp("tab", "complete")
+	return huh.NewForm(
 		huh.NewGroup(
-			huh.NewInput().Key("recipient").Title("Recipient").Value(&m.recipient),
+			m.addressInput("recipient", "Recipient", &m.recipient),
+			m.addressInput("cc", "Cc", &m.cc),
+			m.addressInput("bcc", "Bcc", &m.bcc),
 			huh.NewInput().Key("subject").Title("Subject").Value(&m.subject),
 			huh.NewText().Key("body").Title("Body").Value(&m.body),
 			huh.NewConfirm().
 				Title("Send an Email?").
 				Affirmative("Send").
 				Negative("Cancel").
-				Value(&m.isConfirmed),
+				Value(&m.isConfirmed).
+				Validate(func(send bool) error {
+					msg := m.message()
+					if send && len(msg.To)+len(msg.Cc)+len(msg.Bcc) == 0 {
+						return errors.New("add someone to send it to")
+					}
+					return nil
+				}),
 		),
-	)
-	m.form = form
-	return &m
+	).WithKeyMap(keymap)
+}
+
+// An input for addresses, checked as they're typed and completed from the address book.
+func (m *model) addressInput(key, title string, value *string) *huh.Input {
+	input := huh.NewInput().Key(key).Title(title).Value(value).Validate(validateAddresses)
+	if m.book != nil {
+		input.SuggestionsFunc(func() []string { return m.completions(*value) }, value)
+	}
+	return input
+}
+
+// The field of addresses with the given key, or nil if it isn't one.
+func (m *model) addressField(key string) *string {
+	switch key {
+	case "recipient":
+		return &m.recipient
+	case "cc":
+		return &m.cc
+	case "bcc":
+		return &m.bcc
+	}
+	return nil
+}
+
+// The ways to complete the last recipient typed into a field from the address book, best first.
+// Each is the whole field as it would be completed, since that's what the input matches against what's typed.
+func (m *model) completions(field string) []string {
+	if m.book == nil {
+		return nil
+	}
+	before, last := email.LastRecipient(field)
+	prefix := strings.TrimLeft(last, " ")
+	if prefix == "" {
+		return nil
+	}
+	typed := field[:len(before)+len(last)-len(prefix)]
+	// Those already typed aren't suggested again.
+	already, _ := email.ParseRecipients(before)
+	var completions []string
+	for _, contact := range m.book.Suggest(prefix, suggestionLimit+len(already)) {
+		addr := contact.Email()
+		if len(completions) == suggestionLimit || slices.ContainsFunc(already, addr.Is) {
+			continue
+		}
+		// Completing a name gives it with the address, while completing an address gives just that.
+		completion := addr.String()
+		if !strings.HasPrefix(strings.ToLower(completion), strings.ToLower(prefix)) {
+			completion = addr.Address
+		}
+		// What's already been typed in full is complete, and tab moves on from it.
+		if strings.HasPrefix(strings.ToLower(completion), strings.ToLower(prefix)) && !strings.EqualFold(typed+completion, field) {
+			completions = append(completions, typed+completion)
+		}
+	}
+	return completions
+}
+
+// Handle messages while picking a file to attach.
+func (m *model) updatePicker(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok && msg.String() == "esc" {
+		m.isPicking = false
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	m.picker, cmd = m.picker.Update(msg)
+	if ok, path := m.picker.DidSelectFile(msg); ok {
+		m.isPicking = false
+		attachment, err := email.AttachFile(path)
+		m.attachErr = err
+		if err != nil {
+			log.Warnf("compose: failed to attach %s: %v", path, err)
+		} else {
+			log.Infof("compose: attached %s", path)
+			m.attachments = append(m.attachments, attachment)
+		}
+	}
+	return m, cmd
 }
 
-// The update for the composing model handles the flows for discarding a draft or else sending it.
+// Remove the nth attachment, counting from 1.
+func (m *model) detach(n int) {
+	if n < 1 || n > len(m.attachments) {
+		return
+	}
+	log.Infof("compose: removing attachment %s", m.attachments[n-1].Filename)
+	m.attachments = append(m.attachments[:n-1], m.attachments[n:]...)
+}
+
+// The addresses typed into a field, e.g. the recipients.
+// Anything which doesn't parse as a list of addresses is left whole, to be saved in a draft as it was typed.
+func addresses(field string) []email.Address {
+	addrs, err := email.ParseRecipients(field)
+	if err != nil {
+		return []email.Address{{Address: strings.TrimSpace(field)}}
+	}
+	return addrs
+}
+
+// Check the addresses typed into a field, so that mistakes are shown in place before anything is sent.
+func validateAddresses(field string) error {
+	_, err := email.ParseRecipients(field)
+	return err
+}
+
+// The email as composed so far.
+func (m *model) message() email.Message {
+	return email.Message{
+		MessageHeader: email.MessageHeader{
+			To:         addresses(m.recipient),
+			Cc:         addresses(m.cc),
+			Subject:    m.subject,
+			InReplyTo:  m.inReplyTo,
+			References: m.references,
+			MessageID:  m.messageID,
+			Flags:      m.flags,
+		},
+		Body:        m.body,
+		Attachments: m.attachments,
+		Bcc:         addresses(m.bcc),
+	}
+}
+
+// Leave the composition, asking first whether to keep it as a draft unless there's nothing to keep.
+func (m *model) leave() (tea.Model, tea.Cmd) {
+	if m.message().IsBlank() {
+		log.Debug("compose: leaving a blank message and returning to list view")
+		ForgetAutosave(m.cfg)
+		return m, commands.ListView()
+	}
+	m.isLeaving = true
+	return m, nil
+}
+
+// Handle keys while asking whether to save the message as a draft before leaving.
+func (m *model) updateLeaving(msg tea.Msg) (tea.Model, tea.Cmd) {
+	key, ok := msg.(tea.KeyMsg)
+	if !ok {
+		return m, nil
+	}
+	switch key.String() {
+	case "y", "s":
+		log.Info("compose: saving draft")
+		m.isLeaving = false
+		return m, commands.SaveDraft(m.message())
+	case "n", "d":
+		log.Debug("compose: discarding message and returning to list view")
+		ForgetAutosave(m.cfg)
+		return m, commands.ListView()
+	case "esc":
+		m.isLeaving = false
+		// Cancelling finished the form, so writing on needs a fresh one, which keeps what was written.
+		if m.form.State != huh.StateNormal {
+			m.isConfirmed = false
+			m.form = m.newForm()
+			return m, m.form.Init()
+		}
+	}
+	return m, nil
+}
+
+// The update for the composing model handles the flows for discarding a draft, saving it or else sending it.
 // It is also responsible for forwarding the message to the form for handling.
 func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
+	if msg, ok := msg.(autosaveMsg); ok {
+		// Ticks from an earlier composition stop here.
+		if msg.messageID != m.messageID {
+			return m, nil
+		}
+		m.autosave()
+		return m, m.scheduleAutosave()
+	}
+
+	if m.isLeaving {
+		return m.updateLeaving(msg)
+	}
+
 	if msg, ok := msg.(tea.KeyMsg); ok {
 		switch msg.Type.String() {
 		case "ctrl+c", "q":
-			log.Debug("compose: canceling compose and returning to list view")
-			return m, commands.ListView()
+			return m.leave()
+		}
+	}
+
+	if m.isPicking {
+		return m.updatePicker(msg)
+	}
+
+	if msg, ok := msg.(tea.KeyMsg); ok {
+		switch key := msg.String(); key {
+		case "ctrl+o":
+			m.isPicking = true
+			m.attachErr = nil
+			return m, tea.Batch(m.picker.Init(), tea.WindowSize())
+		case "alt+1", "alt+2", "alt+3", "alt+4", "alt+5", "alt+6", "alt+7", "alt+8", "alt+9":
+			m.detach(int(key[len(key)-1] - '0'))
+			return m, nil
+		}
+	}
+
+	// The form moves on with tab, so tab completes a recipient only while there's one to complete.
+	if key, ok := msg.(tea.KeyMsg); ok && key.String() == "tab" {
+		if field := m.addressField(m.form.GetFocusedField().GetKey()); field != nil && len(m.completions(*field)) > 0 {
+			msg = tea.KeyMsg{Type: tea.KeyCtrlE}
 		}
 	}
 
@@ -89,11 +396,11 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	if m.form.State == huh.StateCompleted {
 		if m.isConfirmed {
 			log.Info(fmt.Sprintf("compose: sending to %s, subject: %s", m.recipient, m.subject))
-			return m, commands.SendEmail(m.recipient, m.subject, m.body)
+			return m, commands.SendEmail(m.message())
 		}
 		if !m.isConfirmed {
-			log.Debug("compose: user canceled sending, returning to list view")
-			return m, commands.ListView()
+			log.Debug("compose: user canceled sending")
+			return m.leave()
 		}
 	}
 
@@ -102,12 +409,58 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 // Render the view.
 func (m *model) View() string {
-	return m.form.View()
+	if m.isPicking {
+		return fmt.Sprintf("Pick a file to attach (esc to cancel):\n\n%s", m.picker.View())
+	}
+	view := lipgloss.JoinVertical(lipgloss.Left, m.form.View(), m.recipientsView(), m.attachmentsView())
+	if m.isLeaving {
+		view = lipgloss.JoinVertical(lipgloss.Left, view, "",
+			promptStyle.Render("Save this as a draft? y save • n discard • esc keep writing"))
+	}
+	return view
+}
+
+// Render the recipients as they'll be sent to, one chip each, once they're typed in full.
+func (m *model) recipientsView() string {
+	lines := []string{}
+	for _, field := range []struct{ title, value string }{{"To", m.recipient}, {"Cc", m.cc}, {"Bcc", m.bcc}} {
+		addrs, err := email.ParseRecipients(field.value)
+		if err != nil || len(addrs) == 0 {
+			continue
+		}
+		chips := make([]string, len(addrs))
+		for i, addr := range addrs {
+			chips[i] = chipStyle.Render(addr.String())
+		}
+		lines = append(lines, helpStyle.Render(fmt.Sprintf("%-4s", field.title))+strings.Join(chips, " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Render the attachments, with how to add and remove them.
+func (m *model) attachmentsView() string {
+	lines := []string{}
+	if m.isRecovered {
+		lines = append(lines, helpStyle.Render("Recovered the message you were writing when jkm last stopped."))
+	}
+	for i, attachment := range m.attachments {
+		lines = append(lines, attachmentStyle.Render(fmt.Sprintf("[%d] %s (%s, %s)",
+			i+1, attachment.Filename, attachment.MIMEType, humanize.Bytes(uint64(attachment.Size)))))
+	}
+	if m.attachErr != nil {
+		lines = append(lines, errStyle.Render(fmt.Sprintf("Couldn't attach that: %v", m.attachErr)))
+	}
+	help := "ctrl+o attach a file"
+	if len(m.attachments) > 0 {
+		help += " • alt+1-9 remove an attachment"
+	}
+	lines = append(lines, helpStyle.Render(help))
+	return strings.Join(lines, "\n")
 }
 
 // Init the underlying form.
 func (m *model) Init() tea.Cmd {
 	log.Info("compose: initializing compose form")
 	m.form.Init()
-	return textinput.Blink
+	return tea.Batch(textinput.Blink, m.scheduleAutosave())
 }
@@ -0,0 +1,72 @@
+package compose
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/contacts"
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Send a message to the model, and whatever it answers with straight away, leaving out ticks.
+func send(m *model, msg tea.Msg) {
+	pending := []tea.Msg{msg}
+	for len(pending) > 0 {
+		msg, pending = pending[0], pending[1:]
+		_, cmd := m.Update(msg)
+		pending = append(pending, answers(cmd)...)
+	}
+}
+
+// The messages a command answers with at once.
+func answers(cmd tea.Cmd) []tea.Msg {
+	if cmd == nil {
+		return nil
+	}
+	answered := make(chan tea.Msg, 1)
+	go func() { answered <- cmd() }()
+	select {
+	case msg := <-answered:
+		if batch, ok := msg.(tea.BatchMsg); ok {
+			var msgs []tea.Msg
+			for _, cmd := range batch {
+				msgs = append(msgs, answers(cmd)...)
+			}
+			return msgs
+		}
+		if msg == nil {
+			return nil
+		}
+		return []tea.Msg{msg}
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestTabLeavesCompletedRecipient(t *testing.T) {
+	log.Init(false)
+	book, err := contacts.Open(filepath.Join(t.TempDir(), "contacts.json"), "me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.Add(time.Now(), email.Address{Address: "bob@example.com"})
+	m := New(&configure.Config{EmailAddress: "me@example.com"}, email.Message{MessageHeader: email.MessageHeader{Subject: "plans"}}, book)
+	for _, msg := range answers(m.form.Init()) {
+		send(m, msg)
+	}
+
+	send(m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("bo")})
+	send(m, tea.KeyMsg{Type: tea.KeyTab})
+	if m.recipient != "bob@example.com" {
+		t.Fatalf("tab completed the recipient to %q, want bob@example.com", m.recipient)
+	}
+	send(m, tea.KeyMsg{Type: tea.KeyTab})
+	if key := m.form.GetFocusedField().GetKey(); key != "cc" {
+		t.Errorf("tab after a completed recipient left the focus on %s, want cc", key)
+	}
+}
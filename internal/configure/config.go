@@ -1,17 +1,82 @@
 package configure
 
 import (
-	// Keeping fmt import for when we uncomment validation
-
-	_ "fmt"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/jcc333/jkm/internal/log"
 	"github.com/joho/godotenv"
 )
 
+// Security is how connections to a server are secured.
+type Security string
+
+const (
+	// TLS from the start, as on ports 993 and 465.
+	ImplicitTLS Security = "tls"
+
+	// Plaintext upgraded to TLS with STARTTLS, as on ports 143 and 587.
+	StartTLS Security = "starttls"
+
+	// No encryption at all, for local test servers.
+	NoSecurity Security = "none"
+)
+
+// Parse a security mode, as in JKM_IMAP_SECURITY.
+func ParseSecurity(s string) (Security, error) {
+	switch security := Security(strings.ToLower(s)); security {
+	case ImplicitTLS, StartTLS, NoSecurity:
+		return security, nil
+	}
+	return "", fmt.Errorf("unknown security %q, expected tls, starttls or none", s)
+}
+
+// Auth is how we sign in to the servers.
+type Auth string
+
+const (
+	// With the IMAP and SMTP passwords.
+	PasswordAuth Auth = "password"
+
+	// With an OAuth2 access token, by SASL XOAUTH2, as Google and Microsoft expect.
+	XOAuth2Auth Auth = "xoauth2"
+
+	// With an OAuth2 access token, by SASL OAUTHBEARER (RFC 7628).
+	OAuthBearerAuth Auth = "oauthbearer"
+)
+
+// Parse a way of signing in, as in JKM_AUTH.
+func ParseAuth(s string) (Auth, error) {
+	switch auth := Auth(strings.ToLower(s)); auth {
+	case PasswordAuth, XOAuth2Auth, OAuthBearerAuth:
+		return auth, nil
+	}
+	return "", fmt.Errorf("unknown auth %q, expected password, xoauth2 or oauthbearer", s)
+}
+
+// OAuthFlow is how the user first authorizes us to use their account with OAuth2.
+type OAuthFlow string
+
+const (
+	// By entering a code we show them on a page of the provider's, on any device.
+	DeviceFlow OAuthFlow = "device"
+
+	// In a browser on this machine, which the provider sends back to a server of ours on the loopback interface.
+	LoopbackFlow OAuthFlow = "loopback"
+)
+
+// Parse an OAuth2 flow, as in JKM_OAUTH_FLOW.
+func ParseOAuthFlow(s string) (OAuthFlow, error) {
+	switch flow := OAuthFlow(strings.ToLower(s)); flow {
+	case DeviceFlow, LoopbackFlow:
+		return flow, nil
+	}
+	return "", fmt.Errorf("unknown OAuth2 flow %q, expected device or loopback", s)
+}
+
 // Global configuration for the application.
 type Config struct {
 	// IMAP server host.
@@ -34,6 +99,74 @@ type Config struct {
 
 	// The user's SMTP password.
 	SMTPPassword string
+
+	// How we sign in to the IMAP and SMTP servers (with their passwords by default).
+	Auth Auth
+
+	// The OAuth2 client we sign in as.
+	OAuthClientID, OAuthClientSecret string
+
+	// The OAuth2 provider's authorization, token and device authorization endpoints.
+	OAuthAuthURL, OAuthTokenURL, OAuthDeviceURL string
+
+	// The OAuth2 scopes to ask for, e.g. https://mail.google.com/.
+	OAuthScopes []string
+
+	// How the user first authorizes us (with a device code by default).
+	OAuthFlow OAuthFlow
+
+	// Where the OAuth2 tokens are kept between runs (in the user's config directory by default).
+	OAuthTokenPath string
+
+	// How connections to the IMAP and SMTP servers are secured (by their ports by default).
+	IMAPSecurity, SMTPSecurity Security
+
+	// A PEM file of extra certificate authorities to trust, beyond the system's.
+	CABundle string
+
+	// The SHA-256 fingerprints of certificates to trust, in hex with or without colons.
+	// When any are given, a server is trusted if and only if it presents one of them, whoever signed it.
+	PinnedCertificates []string
+
+	// Where attachments are saved (~/Downloads by default).
+	DownloadDir string
+
+	// The mailbox messages are archived into (the server's \Archive mailbox by default).
+	ArchiveMailbox string
+
+	// The mailbox a copy of each message we send is saved to (the server's \Sent mailbox by default).
+	SentMailbox string
+
+	// Whether we save a copy of each message we send (on by default).
+	// Providers which save sent mail themselves, such as Gmail, would otherwise end up with two.
+	SaveSent bool
+
+	// The mailbox drafts are saved to (the server's \Drafts mailbox by default).
+	DraftsMailbox string
+
+	// Where the message being composed is kept as it's written, to recover it after a crash
+	// (in the user's cache directory by default). Empty to not keep it.
+	AutosavePath string
+
+	// Whether the list groups messages into conversations (off by default).
+	// Toggling threading in the list changes this for the rest of the session.
+	Threaded bool
+
+	// Where mail is cached for instant start and offline reading (in the user's cache directory by default).
+	// Empty to not cache mail.
+	CachePath string
+
+	// How many bytes of message bodies are kept in memory once read (32 MiB by default).
+	// Zero to not keep any.
+	BodyCacheBytes int
+
+	// How many message bodies are kept in memory once read (500 by default).
+	// Zero to not keep any.
+	BodyCacheMessages int
+
+	// Where the address book of people we've had mail from and sent mail to is kept
+	// (in the user's config directory by default). Empty to only keep it for the session.
+	ContactsPath string
 }
 
 // Load reads configuration from environment variables and .env file
@@ -52,8 +185,17 @@ func Load() (*Config, error) {
 	log.Init(isLogging != "")
 
 	cfg := &Config{
-		IMAPPort: 993,
-		SMTPPort: 587,
+		IMAPPort:  993,
+		SMTPPort:  587,
+		Auth:      PasswordAuth,
+		OAuthFlow: DeviceFlow,
+		SaveSent:  true,
+
+		BodyCacheBytes:    32 << 20,
+		BodyCacheMessages: 500,
+	}
+	if home != "" {
+		cfg.DownloadDir = filepath.Join(home, "Downloads")
 	}
 	if val := os.Getenv("JKM_EMAIL"); val != "" {
 		cfg.EmailAddress = val
@@ -86,5 +228,147 @@ func Load() (*Config, error) {
 	if val := os.Getenv("JKM_IMAP_PASSWORD"); val != "" {
 		cfg.IMAPPassword = val
 	}
+	for key, security := range map[string]*Security{"JKM_IMAP_SECURITY": &cfg.IMAPSecurity, "JKM_SMTP_SECURITY": &cfg.SMTPSecurity} {
+		if val := os.Getenv(key); val != "" {
+			s, err := ParseSecurity(val)
+			if err != nil {
+				log.Errorf("%s error: '%v'", key, err)
+				return nil, err
+			}
+			*security = s
+		}
+	}
+	if val := os.Getenv("JKM_AUTH"); val != "" {
+		auth, err := ParseAuth(val)
+		if err != nil {
+			log.Errorf("JKM_AUTH error: '%v'", err)
+			return nil, err
+		}
+		cfg.Auth = auth
+	}
+	if val := os.Getenv("JKM_OAUTH_FLOW"); val != "" {
+		flow, err := ParseOAuthFlow(val)
+		if err != nil {
+			log.Errorf("JKM_OAUTH_FLOW error: '%v'", err)
+			return nil, err
+		}
+		cfg.OAuthFlow = flow
+	}
+	for key, value := range map[string]*string{
+		"JKM_OAUTH_CLIENT_ID":     &cfg.OAuthClientID,
+		"JKM_OAUTH_CLIENT_SECRET": &cfg.OAuthClientSecret,
+		"JKM_OAUTH_AUTH_URL":      &cfg.OAuthAuthURL,
+		"JKM_OAUTH_TOKEN_URL":     &cfg.OAuthTokenURL,
+		"JKM_OAUTH_DEVICE_URL":    &cfg.OAuthDeviceURL,
+	} {
+		if val := os.Getenv(key); val != "" {
+			*value = val
+		}
+	}
+	if val := os.Getenv("JKM_OAUTH_SCOPES"); val != "" {
+		cfg.OAuthScopes = strings.Fields(strings.ReplaceAll(val, ",", " "))
+	}
+	if configDir, err := os.UserConfigDir(); err == nil && cfg.EmailAddress != "" {
+		cfg.OAuthTokenPath = filepath.Join(configDir, "jkm", cfg.EmailAddress+".token.json")
+	}
+	if val := os.Getenv("JKM_OAUTH_TOKEN_PATH"); val != "" {
+		cfg.OAuthTokenPath = val
+	}
+	if val := os.Getenv("JKM_CA_BUNDLE"); val != "" {
+		cfg.CABundle = val
+	}
+	if val := os.Getenv("JKM_PINNED_CERTS"); val != "" {
+		for _, pin := range strings.Split(val, ",") {
+			if pin = strings.TrimSpace(pin); pin != "" {
+				cfg.PinnedCertificates = append(cfg.PinnedCertificates, pin)
+			}
+		}
+	}
+	if val := os.Getenv("JKM_DOWNLOAD_DIR"); val != "" {
+		cfg.DownloadDir = val
+	}
+	if val := os.Getenv("JKM_ARCHIVE_MAILBOX"); val != "" {
+		cfg.ArchiveMailbox = val
+	}
+	if val := os.Getenv("JKM_SENT_MAILBOX"); val != "" {
+		cfg.SentMailbox = val
+	}
+	if val := os.Getenv("JKM_DRAFTS_MAILBOX"); val != "" {
+		cfg.DraftsMailbox = val
+	}
+	if val := os.Getenv("JKM_SAVE_SENT"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Errorf("JKM_SAVE_SENT error: '%v'", err)
+			return nil, err
+		}
+		cfg.SaveSent = b
+	}
+	if val := os.Getenv("JKM_THREADED"); val != "" {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			log.Errorf("JKM_THREADED error: '%v'", err)
+			return nil, err
+		}
+		cfg.Threaded = b
+	}
+	for key, limit := range map[string]*int{"JKM_BODY_CACHE_BYTES": &cfg.BodyCacheBytes, "JKM_BODY_CACHE_MESSAGES": &cfg.BodyCacheMessages} {
+		if val := os.Getenv(key); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				log.Errorf("%s error: '%v'", key, err)
+				return nil, err
+			}
+			*limit = n
+		}
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil && cfg.EmailAddress != "" {
+		cfg.CachePath = filepath.Join(cacheDir, "jkm", cfg.EmailAddress+".db")
+	}
+	// Set but empty turns the cache off.
+	if val, ok := os.LookupEnv("JKM_CACHE_PATH"); ok {
+		cfg.CachePath = val
+	}
+	if cacheDir, err := os.UserCacheDir(); err == nil && cfg.EmailAddress != "" {
+		cfg.AutosavePath = filepath.Join(cacheDir, "jkm", cfg.EmailAddress+".draft.json")
+	}
+	// Set but empty turns autosaving off.
+	if val, ok := os.LookupEnv("JKM_AUTOSAVE_PATH"); ok {
+		cfg.AutosavePath = val
+	}
+	if configDir, err := os.UserConfigDir(); err == nil && cfg.EmailAddress != "" {
+		cfg.ContactsPath = filepath.Join(configDir, "jkm", cfg.EmailAddress+".contacts.json")
+	}
+	// Set but empty keeps the address book only for the session.
+	if val, ok := os.LookupEnv("JKM_CONTACTS_PATH"); ok {
+		cfg.ContactsPath = val
+	}
 	return cfg, nil
 }
+
+// How connections to the IMAP server are secured: as set, or else STARTTLS on port 143 and TLS anywhere else.
+func (c *Config) IMAPConnectionSecurity() Security {
+	if c.IMAPSecurity != "" {
+		return c.IMAPSecurity
+	}
+	if c.IMAPPort == 143 {
+		return StartTLS
+	}
+	return ImplicitTLS
+}
+
+// How connections to the SMTP server are secured: as set, or else TLS on port 465 and STARTTLS anywhere else.
+func (c *Config) SMTPConnectionSecurity() Security {
+	if c.SMTPSecurity != "" {
+		return c.SMTPSecurity
+	}
+	if c.SMTPPort == 465 {
+		return ImplicitTLS
+	}
+	return StartTLS
+}
+
+// Whether we sign in with OAuth2 rather than passwords.
+func (c *Config) UsesOAuth() bool {
+	return c.Auth == XOAuth2Auth || c.Auth == OAuthBearerAuth
+}
@@ -0,0 +1,241 @@
+package contacts
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// A local address book, filled in from the mail we read and send, to suggest recipients from.
+//
+// Everyone a message we read was from or to, and everyone we send to, is remembered with how often
+// and how lately we've seen them. Those we deal with most, and most lately, are suggested first.
+// The book is kept as JSON, and can be filled from or written out as vCards.
+
+// How long it takes for a contact's use to count half as much towards their rank.
+const halfLife = 30 * 24 * time.Hour
+
+// Contact is someone we've had mail from or sent mail to.
+type Contact struct {
+	// Their name, as they last gave it, if they have.
+	Name string
+
+	// Their bare address.
+	Address string
+
+	// How many messages we've read from or to them, or sent them.
+	Count int
+
+	// When we last read mail from or to them, or sent them some.
+	LastSeen time.Time
+}
+
+// Email is the contact as an address to send to.
+func (c Contact) Email() email.Address {
+	return email.Address{Name: c.Name, Address: c.Address}
+}
+
+// How highly the contact ranks at the given time: how often we've seen them, counting less the longer ago that was.
+func (c Contact) score(now time.Time) float64 {
+	return float64(c.Count) * math.Pow(0.5, float64(now.Sub(c.LastSeen))/float64(halfLife))
+}
+
+// Book is the address book of one account.
+type Book struct {
+	// Where the book is kept, or empty to only keep it in memory.
+	path string
+
+	// The account's own address, which is never a contact.
+	self string
+
+	mu sync.Mutex
+
+	// Held while saving, so that saves made at once are written one after the other.
+	saving sync.Mutex
+
+	// The contacts by their lower-cased address.
+	contacts map[string]*Contact
+
+	// The Message-IDs of messages read since the book was opened, so that reading one again doesn't count twice.
+	read map[string]bool
+}
+
+// Open the book kept at path, for the account with the given address.
+// A book which hasn't been kept yet starts empty, and an empty path keeps the book only in memory.
+func Open(path, self string) (*Book, error) {
+	b := &Book{
+		path:     path,
+		self:     strings.ToLower(self),
+		contacts: map[string]*Contact{},
+		read:     map[string]bool{},
+	}
+	if path == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var contacts []Contact
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, err
+	}
+	for _, contact := range contacts {
+		contact := contact
+		b.contacts[strings.ToLower(contact.Address)] = &contact
+	}
+	log.Infof("opened %d contacts at %s", len(contacts), path)
+	return b, nil
+}
+
+// Save the book, if it's kept anywhere.
+func (b *Book) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.saving.Lock()
+	defer b.saving.Unlock()
+	b.mu.Lock()
+	data, err := json.MarshalIndent(b.ranked(time.Now()), "", "  ")
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(b.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	// Written aside and renamed into place, so that a crash mid-write can't lose the book.
+	tmp, err := os.CreateTemp(dir, filepath.Base(b.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// Add that we've dealt with these people at the given time.
+func (b *Book) Add(at time.Time, addrs ...email.Address) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, addr := range addrs {
+		contact := b.contact(addr)
+		if contact == nil {
+			continue
+		}
+		contact.Count++
+		if at.After(contact.LastSeen) {
+			contact.LastSeen = at
+		}
+	}
+}
+
+// HarvestRead remembers the people a message we read was from and to.
+// Drafts are our own, and a message read again since the book was opened doesn't count twice.
+func (b *Book) HarvestRead(msg *email.Message) {
+	if msg == nil || msg.Flags.Has(email.Draft) {
+		return
+	}
+	b.mu.Lock()
+	isRead := b.read[msg.MessageID]
+	if msg.MessageID != "" {
+		b.read[msg.MessageID] = true
+	}
+	b.mu.Unlock()
+	if isRead {
+		return
+	}
+	addrs := append([]email.Address{msg.From}, msg.To...)
+	b.Add(time.Now(), append(addrs, msg.Cc...)...)
+}
+
+// HarvestSent remembers the people we sent a message to, blind copies and all.
+func (b *Book) HarvestSent(msg email.Message) {
+	addrs := append(append([]email.Address{}, msg.To...), msg.Cc...)
+	b.Add(time.Now(), append(addrs, msg.Bcc...)...)
+}
+
+// The contact for an address, added if it's new, and named as the address last was.
+// Nil for our own address and anything which isn't an address at all.
+// Expects the lock to be held.
+func (b *Book) contact(addr email.Address) *Contact {
+	key := strings.ToLower(strings.TrimSpace(addr.Address))
+	if key == "" || key == b.self || !strings.Contains(key, "@") {
+		return nil
+	}
+	contact, ok := b.contacts[key]
+	if !ok {
+		contact = &Contact{Address: strings.TrimSpace(addr.Address)}
+		b.contacts[key] = contact
+	}
+	if name := strings.TrimSpace(addr.Name); name != "" {
+		contact.Name = name
+	}
+	return contact
+}
+
+// Contacts are everyone in the book, best ranked first.
+func (b *Book) Contacts() []Contact {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ranked(time.Now())
+}
+
+// Suggest up to limit contacts whose name or address starts with prefix, whatever its case, best ranked first.
+func (b *Book) Suggest(prefix string, limit int) []Contact {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var suggestions []Contact
+	for _, contact := range b.ranked(time.Now()) {
+		if len(suggestions) == limit {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(contact.Name), prefix) || strings.HasPrefix(strings.ToLower(contact.Address), prefix) {
+			suggestions = append(suggestions, contact)
+		}
+	}
+	return suggestions
+}
+
+// Everyone in the book, best ranked at the given time first, then those seen latest, then by address.
+// Expects the lock to be held.
+func (b *Book) ranked(now time.Time) []Contact {
+	contacts := make([]Contact, 0, len(b.contacts))
+	for _, contact := range b.contacts {
+		contacts = append(contacts, *contact)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		a, b := contacts[i], contacts[j]
+		if sa, sb := a.score(now), b.score(now); sa != sb {
+			return sa > sb
+		}
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+		return strings.ToLower(a.Address) < strings.ToLower(b.Address)
+	})
+	return contacts
+}
@@ -0,0 +1,107 @@
+package contacts
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+func openTestBook(t *testing.T) (*Book, string) {
+	t.Helper()
+	log.Init(false)
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	b, err := Open(path, "me@example.com")
+	if err != nil {
+		t.Fatalf("Failed to open book: %v", err)
+	}
+	return b, path
+}
+
+func TestHarvestRanksByFrequencyAndRecency(t *testing.T) {
+	b, path := openTestBook(t)
+	now := time.Now()
+	alice := email.Address{Name: "Alice A", Address: "alice@example.com"}
+	// Often, but long ago.
+	for i := 0; i < 4; i++ {
+		b.Add(now.Add(-120*24*time.Hour), alice)
+	}
+	b.Add(now.Add(-time.Hour), email.Address{Address: "alan@example.com"})
+	b.HarvestRead(&email.Message{MessageHeader: email.MessageHeader{
+		MessageID: "<1@example.com>",
+		From:      email.Address{Name: "Al B", Address: "AL@example.com"},
+		To:        []email.Address{{Address: "me@example.com"}},
+	}})
+	// Reading it again doesn't count.
+	b.HarvestRead(&email.Message{MessageHeader: email.MessageHeader{
+		MessageID: "<1@example.com>",
+		From:      email.Address{Name: "Al B", Address: "al@example.com"},
+	}})
+	b.HarvestSent(email.Message{MessageHeader: email.MessageHeader{To: []email.Address{{Address: "al@example.com"}}}})
+
+	var addrs []string
+	for _, contact := range b.Suggest("al", 5) {
+		addrs = append(addrs, contact.Address)
+	}
+	if got, want := strings.Join(addrs, " "), "AL@example.com alan@example.com alice@example.com"; got != want {
+		t.Errorf("Expected suggestions %q, got %q", want, got)
+	}
+	if suggestions := b.Suggest("me", 5); len(suggestions) != 0 {
+		t.Errorf("Expected our own address not to be suggested, got %+v", suggestions)
+	}
+	if suggestions := b.Suggest("alice a", 5); len(suggestions) != 1 || suggestions[0].Name != "Alice A" {
+		t.Errorf("Expected a suggestion by name, got %+v", suggestions)
+	}
+
+	if err := b.Save(); err != nil {
+		t.Fatalf("Failed to save book: %v", err)
+	}
+	reopened, err := Open(path, "me@example.com")
+	if err != nil {
+		t.Fatalf("Failed to reopen book: %v", err)
+	}
+	if contacts := reopened.Contacts(); len(contacts) != 3 || contacts[0].Count != 2 || contacts[0].Name != "Al B" {
+		t.Errorf("Expected the book kept as it was, got %+v", contacts)
+	}
+}
+
+func TestVCardRoundTrip(t *testing.T) {
+	b, _ := openTestBook(t)
+	cards := "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Last\\, First\r\nN:Last;First;;;\r\n" +
+		"item1.EMAIL;TYPE=work:first@exam\r\n ple.com\r\nEMAIL:other@example.com\r\nTEL:123\r\nEND:VCARD\r\n" +
+		"BEGIN:VCARD\nVERSION:3.0\nN:Petrov;Ivan;;;\nEMAIL:ivan@example.ru\nEMAIL:not an address\nEND:VCARD\n"
+	added, err := b.ImportVCard(strings.NewReader(cards))
+	if err != nil || added != 3 {
+		t.Fatalf("Expected 3 addresses imported, got %d, %v", added, err)
+	}
+	if added, err := b.ImportVCard(strings.NewReader(cards)); err != nil || added != 0 {
+		t.Fatalf("Expected nothing added importing the same cards again, got %d, %v", added, err)
+	}
+	if suggestions := b.Suggest("ivan p", 1); len(suggestions) != 1 || suggestions[0].Address != "ivan@example.ru" {
+		t.Errorf("Expected a name from N, got %+v", suggestions)
+	}
+
+	var exported bytes.Buffer
+	if err := b.ExportVCard(&exported); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	if !strings.Contains(exported.String(), "FN:Last\\, First\r\n") {
+		t.Errorf("Expected the name escaped, got:\n%s", exported.String())
+	}
+	if n := strings.Count(exported.String(), "\r\nN:;;;;\r\n"); n != 3 || strings.Count(exported.String(), "\r\nN:") != n {
+		t.Errorf("Expected the name left out of N, got:\n%s", exported.String())
+	}
+	again, _ := openTestBook(t)
+	if added, err := again.ImportVCard(&exported); err != nil || added != 3 {
+		t.Fatalf("Expected the export to import again, got %d, %v", added, err)
+	}
+	for _, contact := range again.Contacts() {
+		if contact.Address == "first@example.com" && contact.Name != "Last, First" {
+			t.Errorf("Expected the name to survive, got %+v", contact)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package contacts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jcc333/jkm/internal/email"
+)
+
+// Reading and writing the book as vCards, to share it with other address books.
+// Only names and email addresses are kept; everything else on a card is passed over.
+// See RFC 6350, and RFC 2426 for version 3.0, which is what's written.
+
+// Longest a line of a written card may be, in bytes, before it's folded.
+const lineLength = 75
+
+// ImportVCard adds the email addresses on the cards read from r, named as their cards are,
+// and says how many it added. Importing doesn't count as dealing with anyone, so ranks are unchanged.
+func (b *Book) ImportVCard(r io.Reader) (int, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var (
+		added      int
+		isCard     bool
+		name, n    string
+		emailAddrs []string
+	)
+	for _, line := range lines {
+		property, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(property, ";")
+		// A property may be grouped, e.g. "item1.EMAIL".
+		key := params[0]
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			key = key[i+1:]
+		}
+		switch key = strings.ToUpper(key); {
+		case key == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			isCard, name, n, emailAddrs = true, "", "", nil
+		case key == "END" && strings.EqualFold(value, "VCARD") && isCard:
+			isCard = false
+			if name == "" {
+				name = n
+			}
+			for _, addr := range emailAddrs {
+				// Those already in the book are renamed, but weren't added.
+				_, known := b.contacts[strings.ToLower(strings.TrimSpace(addr))]
+				if b.contact(email.Address{Name: name, Address: addr}) != nil && !known {
+					added++
+				}
+			}
+		case !isCard:
+		case key == "FN":
+			name = unescape(value)
+		case key == "N":
+			// Family; Given; Additional; Prefixes; Suffixes, of which a name needs the first two.
+			parts := splitComponents(value)
+			for len(parts) < 2 {
+				parts = append(parts, "")
+			}
+			n = strings.TrimSpace(unescape(parts[1]) + " " + unescape(parts[0]))
+		case key == "EMAIL":
+			addr := strings.TrimPrefix(strings.TrimSpace(unescape(value)), "mailto:")
+			if parsed, err := email.ParseAddress(addr); err == nil {
+				emailAddrs = append(emailAddrs, parsed.Address)
+			}
+		}
+	}
+	return added, nil
+}
+
+// ExportVCard writes a card for each contact to w, best ranked first.
+func (b *Book) ExportVCard(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, contact := range b.Contacts() {
+		name := contact.Name
+		if name == "" {
+			name = contact.Address
+		}
+		for _, line := range []string{
+			"BEGIN:VCARD",
+			"VERSION:3.0",
+			"FN:" + escape(name),
+			// N is required, but the name can't be told apart into family and given, so it's left to FN.
+			"N:;;;;",
+			"EMAIL;TYPE=INTERNET:" + escape(contact.Address),
+			"END:VCARD",
+		} {
+			if _, err := bw.WriteString(fold(line)); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// The logical lines of vCards, joining folded lines back together.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading vCards: %w", err)
+	}
+	return lines, nil
+}
+
+// Fold a line longer than a card allows onto continuation lines, without splitting a character.
+func fold(line string) string {
+	var sb strings.Builder
+	width := 0
+	for _, r := range line {
+		size := len(string(r))
+		if width+size > lineLength {
+			sb.WriteString("\r\n ")
+			width = 1
+		}
+		sb.WriteRune(r)
+		width += size
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// Split a structured value at the semicolons between its components, leaving escaped ones alone.
+func splitComponents(value string) []string {
+	var (
+		parts []string
+		start int
+	)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ';':
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+var unescaper = strings.NewReplacer(`\\`, `\`, `\,`, `,`, `\;`, `;`, `\n`, "\n", `\N`, "\n")
+
+var escaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `;`, `\;`, "\n", `\n`)
+
+// The text of a value, with its escapes undone.
+func unescape(value string) string {
+	return unescaper.Replace(value)
+}
+
+// Text as a value, escaped.
+func escape(text string) string {
+	return escaper.Replace(text)
+}
@@ -0,0 +1,191 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/charset"
+)
+
+// Addresses and the header fields they're written in, e.g. "F Last <flast@example.com>".
+// Names and subjects may arrive as RFC 2047 encoded-words in any charset, and are kept decoded.
+// See RFC 5322 section 3.4.
+
+// Address is someone mail is sent to or from.
+type Address struct {
+	// Their name, decoded, if it's known, e.g. "F Last".
+	Name string
+
+	// Their bare address, e.g. "flast@example.com".
+	Address string
+}
+
+// Decodes encoded-words in every charset go-message knows, not only UTF-8 and Latin-1.
+var wordDecoder = &mime.WordDecoder{CharsetReader: charset.Reader}
+
+// Parses addresses with names in any charset.
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// An RFC 2047 encoded-word, e.g. "=?utf-8?q?caf=C3=A9?=".
+var encodedWord = regexp.MustCompile(`=\?[^?\s]+\?[bBqQ]\?[^?\s]*\?=`)
+
+// DecodeHeader decodes the encoded-words in a header field's value.
+// Words which can't be decoded, e.g. for their charset, are left as they are, without spoiling the rest.
+func DecodeHeader(value string) string {
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return encodedWord.ReplaceAllStringFunc(value, func(word string) string {
+		if decoded, err := wordDecoder.Decode(word); err == nil {
+			return decoded
+		}
+		return word
+	})
+}
+
+// ParseAddress parses a single address, e.g. "F Last <flast@example.com>" or "flast@example.com".
+func ParseAddress(s string) (Address, error) {
+	addr, err := addressParser.Parse(s)
+	if err != nil {
+		return Address{}, err
+	}
+	return Address{Name: addr.Name, Address: addr.Address}, nil
+}
+
+// ParseAddressList parses a comma-separated list of addresses.
+// A group, e.g. "Team: alice@example.com, bob@example.com;", stands for its members, so an empty one stands for no one.
+func ParseAddressList(s string) ([]Address, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	addrs, err := addressParser.ParseList(s)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Address, len(addrs))
+	for i, addr := range addrs {
+		list[i] = Address{Name: addr.Name, Address: addr.Address}
+	}
+	return list, nil
+}
+
+// ParseRecipients parses addresses as people type them, separated by commas or semicolons,
+// with or without names, e.g. "Alice <alice@example.com>; bob@example.com,".
+// It fails on the first entry which isn't an address, saying which it is.
+func ParseRecipients(s string) ([]Address, error) {
+	if addrs, err := ParseAddressList(s); err == nil {
+		return addrs, nil
+	}
+	var addrs []Address
+	for _, entry := range splitRecipients(s) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, err := ParseAddress(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an email address", entry)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// LastRecipient splits typed recipients into the last of them, e.g. to complete it as it's typed,
+// and everything before it, separators and all.
+func LastRecipient(s string) (before, last string) {
+	entries := splitRecipients(s)
+	last = entries[len(entries)-1]
+	return s[:len(s)-len(last)], last
+}
+
+// Split typed recipients at the commas and semicolons between them,
+// leaving those in quoted names, angle brackets and comments alone.
+func splitRecipients(s string) []string {
+	var (
+		entries  []string
+		start    int
+		isQuoted bool
+		depth    int
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case isQuoted && c == '\\':
+			i++
+		case c == '"':
+			isQuoted = !isQuoted
+		case isQuoted:
+		case c == '<' || c == '(':
+			depth++
+		case (c == '>' || c == ')') && depth > 0:
+			depth--
+		case (c == ',' || c == ';') && depth == 0:
+			entries = append(entries, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(entries, s[start:])
+}
+
+// String formats the address to show, e.g. "F Last <flast@example.com>", or just the address if there's no name.
+// Names which would otherwise be misread as more than one address are quoted, so the result parses back.
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Address
+	}
+	name := a.Name
+	if strings.ContainsAny(name, `,;:<>@."()[]\`) {
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	return name + " <" + a.Address + ">"
+}
+
+// Header formats the address for a header field, encoding a name which isn't ASCII.
+func (a Address) Header() string {
+	if a.Name == "" {
+		return a.Address
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Address}).String()
+}
+
+// Is reports whether two addresses are the same mailbox, whatever their names.
+func (a Address) Is(other Address) bool {
+	return strings.EqualFold(a.Address, other.Address)
+}
+
+// UnmarshalJSON reads an address, or the string an address was cached as before they had names.
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if addr, err := ParseAddress(s); err == nil {
+			*a = addr
+		} else {
+			*a = Address{Address: s}
+		}
+		return nil
+	}
+	type address Address
+	return json.Unmarshal(data, (*address)(a))
+}
+
+// FormatAddresses formats a list of addresses to show, e.g. "F Last <flast@example.com>, bob@example.com".
+func FormatAddresses(addrs []Address) string {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// BareAddresses are the addresses without their names, e.g. to give an SMTP server.
+func BareAddresses(addrs []Address) []string {
+	bare := make([]string, len(addrs))
+	for i, addr := range addrs {
+		bare[i] = addr.Address
+	}
+	return bare
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	for encoded, expected := range map[string]string{
+		"=?ISO-2022-JP?B?GyRCJUYlOSVIGyhC?=":            "テスト",
+		"=?windows-1251?B?yOLg7Q==?= Petrov":            "Иван Petrov",
+		"=?utf-8?q?caf=C3=A9?= =?utf-8?q?_cr=C3=A8me?=": "café crème",
+		// An unknown charset spoils only its own word.
+		"=?x-unknown?q?abc?= =?utf-8?q?caf=C3=A9?=": "=?x-unknown?q?abc?= café",
+		"plain": "plain",
+	} {
+		if decoded := DecodeHeader(encoded); decoded != expected {
+			t.Errorf("Expected %q to decode to %q, got %q", encoded, expected, decoded)
+		}
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	addrs, err := ParseAddressList(`Team: alice@example.com, "Last, First" <first@example.com>;, =?windows-1251?B?yOL g7Q==?= <ivan@example.ru>, undisclosed-recipients:;`)
+	if err != nil {
+		t.Fatalf("Failed to parse addresses: %v", err)
+	}
+	expected := []Address{
+		{Address: "alice@example.com"},
+		{Name: "Last, First", Address: "first@example.com"},
+		{Name: "=?windows-1251?B?yOL g7Q==?=", Address: "ivan@example.ru"},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, addrs)
+	}
+
+	addrs, err = ParseAddressList("=?windows-1251?B?yOLg7Q==?= <ivan@example.ru>")
+	if err != nil || len(addrs) != 1 || addrs[0].Name != "Иван" {
+		t.Errorf("Expected the name decoded from windows-1251, got %+v, %v", addrs, err)
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	for addr, expected := range map[Address]string{
+		{Address: "foo@example.com"}:                    "foo@example.com",
+		{Name: "F Last", Address: "flast@example.com"}:  "F Last <flast@example.com>",
+		{Name: "Last, F", Address: "flast@example.com"}: `"Last, F" <flast@example.com>`,
+		{Name: "Иван", Address: "ivan@example.ru"}:      "Иван <ivan@example.ru>",
+	} {
+		if s := addr.String(); s != expected {
+			t.Errorf("Expected %q, got %q", expected, s)
+		}
+		parsed, err := ParseAddress(addr.String())
+		if err != nil || parsed != addr {
+			t.Errorf("Expected %q to parse back to %+v, got %+v, %v", addr.String(), addr, parsed, err)
+		}
+	}
+	if header := (Address{Name: "Иван", Address: "ivan@example.ru"}).Header(); header != "=?utf-8?q?=D0=98=D0=B2=D0=B0=D0=BD?= <ivan@example.ru>" {
+		t.Errorf("Expected the name encoded for the header, got %q", header)
+	}
+}
+
+func TestUnmarshalCachedAddress(t *testing.T) {
+	var header MessageHeader
+	if err := json.Unmarshal([]byte(`{"From": "F Last <flast@example.com>", "To": ["bob@example.com"]}`), &header); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if header.From != (Address{Name: "F Last", Address: "flast@example.com"}) || !reflect.DeepEqual(header.To, []Address{{Address: "bob@example.com"}}) {
+		t.Errorf("Expected addresses read from strings, got %+v and %+v", header.From, header.To)
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	addrs, err := ParseRecipients(`Alice <alice@example.com>; "Last, First" <first@example.com>, bob@example.com;`)
+	if err != nil {
+		t.Fatalf("Failed to parse recipients: %v", err)
+	}
+	expected := []Address{
+		{Name: "Alice", Address: "alice@example.com"},
+		{Name: "Last, First", Address: "first@example.com"},
+		{Address: "bob@example.com"},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, addrs)
+	}
+
+	if _, err := ParseRecipients("alice@example.com; bob@"); err == nil || err.Error() != `"bob@" is not an email address` {
+		t.Errorf("Expected an error naming the bad address, got %v", err)
+	}
+
+	if before, last := LastRecipient(`"Last, First" <first@example.com>; bo`); before != `"Last, First" <first@example.com>;` || last != " bo" {
+		t.Errorf("Expected the last recipient split off, got %q and %q", before, last)
+	}
+}
@@ -0,0 +1,60 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The MIME type of files we can't identify.
+const octetStream = "application/octet-stream"
+
+// AttachFile describes a local file as an attachment for an outgoing message.
+// The MIME type comes from the file's extension, or else from sniffing its content.
+func AttachFile(path string) (Attachment, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Attachment{}, err
+	}
+	if info.IsDir() {
+		return Attachment{}, fmt.Errorf("%s is a directory", path)
+	}
+
+	mimeType, err := detectMIMEType(path)
+	if err != nil {
+		return Attachment{}, err
+	}
+	return Attachment{
+		Path:     path,
+		Filename: filepath.Base(path),
+		MIMEType: mimeType,
+		Size:     int(info.Size()),
+	}, nil
+}
+
+// Work out a file's MIME type.
+func detectMIMEType(path string) (string, error) {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// DetectContentType only ever considers the first 512 bytes.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if n == 0 {
+		return octetStream, nil
+	}
+	return http.DetectContentType(head[:n]), nil
+}
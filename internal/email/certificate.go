@@ -0,0 +1,40 @@
+package email
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// CertificateError is returned when a server's certificate can't be trusted.
+// It keeps the certificates, so that the user can see what they'd be trusting.
+type CertificateError struct {
+	// The server which presented the certificates, e.g. imap.example.com.
+	Host string
+
+	// The certificates the server presented, its own first.
+	Certificates []*x509.Certificate
+
+	// Why they couldn't be trusted.
+	Err error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("the certificate of %s can't be trusted: %v", e.Host, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// The SHA-256 fingerprint of a certificate, as colon-separated hex, e.g. "AB:CD:...".
+// This is how certificates are pinned.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
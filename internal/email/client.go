@@ -1,6 +1,8 @@
 package email
 
 import (
+	"errors"
+	"net"
 	"time"
 )
 
@@ -8,16 +10,78 @@ import (
 // Used for efficient listing without loading full message content
 type MessageHeader struct {
 	ID      int
-	From    string
-	To      []string
+	From    Address
+	To      []Address
 	Subject string
 	Date    time.Time
+	Flags   Flag
+
+	// Whoever else the message was sent to.
+	Cc []Address
+
+	// Where the sender asked for replies to go, if not to them.
+	ReplyTo []Address
+
+	// The message's globally unique Message-ID, e.g. "<1234@example.com>".
+	MessageID string
+
+	// The Message-ID of the message this one replies to.
+	InReplyTo string
+
+	// The Message-IDs of the messages in this one's thread, oldest first.
+	References []string
 }
 
 // Message represents a complete email message including body content
 type Message struct {
 	MessageHeader
+
+	// The text to display, taken from the best of the message's parts.
 	Body string
+
+	// The message's decoded text parts, in the order they appear in the message.
+	Parts []Part
+
+	// The files attached to the message, whose content is fetched separately.
+	Attachments []Attachment
+
+	// Who else the message is sent to, without anyone else knowing.
+	// Drafts keep these in their header, so that they're still there when a draft is resumed; sent messages never do.
+	Bcc []Address
+
+	// The message's whole header block as it was sent, for showing every header field.
+	// Empty for messages we're sending, and those read before it was kept.
+	RawHeader string
+}
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	// The attachment's IMAP section path, e.g. "2".
+	PartID string
+
+	// The attachment's file name, if it has one.
+	Filename string
+
+	// The attachment's MIME type, e.g. "application/pdf".
+	MIMEType string
+
+	// The attachment's size in bytes, as encoded in the message.
+	Size int
+
+	// The local file to attach, for messages we're sending.
+	Path string
+}
+
+// Part is a single text part of a message, decoded to UTF-8.
+type Part struct {
+	// The part's IMAP section path, e.g. "1.2".
+	ID string
+
+	// The part's MIME type, e.g. "text/plain".
+	MIMEType string
+
+	// The part's decoded content.
+	Content string
 }
 
 // A type for sending emails.
@@ -26,15 +90,172 @@ type Sender interface {
 }
 
 // A type for receiving emails.
+// Listing, reading and counting all act on the selected mailbox.
 type Receiver interface {
 	List(shouldBustCache bool) ([]MessageHeader, error)
 	Read(id int) (*Message, error)
 	CountMessages() (int, error)
+
+	// The headers of the messages as last seen, newest first, without waiting on the server.
+	Cached() []MessageHeader
+
+	// The messages grouped into conversations, newest first.
+	Threads() ([]Thread, error)
+
+	// The headers of the messages matching a query, newest first.
+	Search(query Query) ([]MessageHeader, error)
+
+	// Set or clear a flag on a message, e.g. to mark it read.
+	SetFlag(id int, flag Flag, on bool) error
+
+	// Move a message to the trash, or remove it for good if it's already there.
+	Delete(id int) error
+
+	// Move a message out of the way into the archive mailbox.
+	Archive(id int) error
+
+	// Move a message to the named mailbox.
+	Move(id int, mailbox string) error
+
+	// The decoded content of one of a message's attachments.
+	ReadAttachment(id int, attachment Attachment) ([]byte, error)
+
+	// The whole of a message as it was sent, headers and all.
+	Source(id int) ([]byte, error)
+
+	// All of the mailboxes on the server, with their message counts.
+	Mailboxes() ([]Mailbox, error)
+
+	// Work in the named mailbox from now on.
+	Select(name string) error
+
+	// The name of the mailbox being worked in.
+	Selected() string
+}
+
+// An Update is a change to a mailbox which the server pushed to us.
+type Update interface {
+	isUpdate()
+}
+
+// NewMessages is pushed when messages arrive in a mailbox.
+type NewMessages struct {
+	// The mailbox which received the messages.
+	Mailbox string
+
+	// The number of messages in the mailbox after the arrival.
+	Count int
+}
+
+// Expunged is pushed when a message is permanently removed from a mailbox.
+type Expunged struct {
+	// The mailbox which lost the message.
+	Mailbox string
+
+	// The sequence number the message had before it was removed.
+	SeqNum uint32
+}
+
+// FlagsChanged is pushed when the flags on a message change.
+type FlagsChanged struct {
+	// The mailbox holding the message.
+	Mailbox string
+
+	// The sequence number of the message.
+	SeqNum uint32
+
+	// The message's flags after the change.
+	Flags Flag
+}
+
+// ConnectionState is how things stand with the connection to the server.
+type ConnectionState int
+
+const (
+	// Connected to the server.
+	Connected ConnectionState = iota
+
+	// The connection dropped, and we're trying to get it back.
+	Reconnecting
+
+	// We've failed to reconnect for a while, and are working from what we have until we do.
+	Offline
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	case Offline:
+		return "offline"
+	}
+	return "unknown"
+}
+
+// ErrOffline is what commands which need the server fail with while we aren't connected to it.
+var ErrOffline = errors.New("not connected to the mail server")
+
+// IsOffline reports whether err is for want of a connection to the server, rather than a real failure.
+// How the connection stands is pushed as ConnectionChanged, so these needn't interrupt the user.
+// A certificate which can't be trusted is never only a connection problem.
+func IsOffline(err error) bool {
+	var (
+		netErr  net.Error
+		certErr *CertificateError
+	)
+	if errors.As(err, &certErr) {
+		return false
+	}
+	return errors.Is(err, ErrOffline) || errors.As(err, &netErr)
+}
+
+// ConnectionChanged is pushed when the connection to the server drops, or comes back.
+type ConnectionChanged struct {
+	State ConnectionState
+
+	// When we'll next try to reconnect, if we're not connected.
+	// Zero while offline means we've stopped trying, for a reason the user has to see to.
+	Retry time.Time
+
+	// Why we're not connected, if we're not.
+	Err error
+}
+
+func (NewMessages) isUpdate()       {}
+func (Expunged) isUpdate()          {}
+func (FlagsChanged) isUpdate()      {}
+func (ConnectionChanged) isUpdate() {}
+
+// A type for being told about changes to mailboxes as they happen.
+type Watcher interface {
+	// Updates yields mailbox changes as the server reports them.
+	Updates() <-chan Update
+}
+
+// A type for keeping unfinished messages in the drafts mailbox.
+// Drafts are known by their Message-IDs, which stay the same however many times they're saved.
+type Drafter interface {
+	// Save a draft, replacing any earlier save of it.
+	SaveDraft(draft Message) error
+
+	// Remove every save of a draft, e.g. once it's been sent.
+	DeleteDraft(draft Message) error
+}
+
+// A type for fetching messages before they're read, so that opening them is instant.
+type Prefetcher interface {
+	// Fetch the messages in the selected mailbox with the given IDs in the background, in order,
+	// giving way to anything more pressing. Each call replaces the last, whose fetching stops.
+	Prefetch(ids []int)
 }
 
 // A type for sending or receiving emails.
 type Client interface {
 	Sender
 	Receiver
+	Drafter
+	Watcher
 	Disconnect() error
 }
@@ -0,0 +1,27 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A new Message-ID for a message from the given address, e.g. "<1a2b3c.1700000000@example.com>".
+// A message gets its Message-ID when we start composing it, so that every save of it as a draft is known as the same one.
+func NewMessageID(from string) string {
+	domain := "localhost"
+	address := bareAddress(from)
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		domain = address[at+1:]
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(random), time.Now().Unix(), domain)
+}
+
+// Whether nothing has been written in a message yet, so there's nothing to lose by dropping it.
+func (m Message) IsBlank() bool {
+	return len(m.To) == 0 && len(m.Cc) == 0 && len(m.Bcc) == 0 && strings.TrimSpace(m.Subject) == "" && strings.TrimSpace(m.Body) == "" && len(m.Attachments) == 0
+}
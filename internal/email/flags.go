@@ -0,0 +1,32 @@
+package email
+
+// Flag is one of the states the server keeps for a message, such as read or starred.
+// Flags combine, so a message's flags are held in a single Flag.
+type Flag uint8
+
+const (
+	// The message has been read.
+	Seen Flag = 1 << iota
+
+	// The message is starred for attention.
+	Flagged
+
+	// The message has been replied to.
+	Answered
+
+	// The message is an unfinished draft.
+	Draft
+)
+
+// Whether all of the given flags are set.
+func (f Flag) Has(flag Flag) bool {
+	return f&flag == flag
+}
+
+// The flags with the given flags set or cleared.
+func (f Flag) With(flag Flag, on bool) Flag {
+	if on {
+		return f | flag
+	}
+	return f &^ flag
+}
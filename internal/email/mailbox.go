@@ -0,0 +1,59 @@
+package email
+
+import (
+	"strings"
+)
+
+// A Mailbox is a folder of messages on the server, e.g. INBOX, Sent or Archive/2024.
+type Mailbox struct {
+	// The mailbox's full name, including its parents.
+	Name string
+
+	// The separator between levels of the hierarchy in Name, e.g. "/".
+	// Empty if the server's namespace is flat.
+	Delimiter string
+
+	// The mailbox's attributes, such as \Noselect, \HasChildren or \Sent.
+	Attributes []string
+
+	// The number of messages in the mailbox.
+	Messages int
+
+	// The number of unread messages in the mailbox.
+	Unread int
+}
+
+// The mailbox every server has, which receives new mail.
+const Inbox = "INBOX"
+
+// How deeply nested the mailbox is, with top-level mailboxes at 0.
+func (m Mailbox) Depth() int {
+	if m.Delimiter == "" {
+		return 0
+	}
+	return strings.Count(m.Name, m.Delimiter)
+}
+
+// The last component of the mailbox's name, without its parents.
+func (m Mailbox) Leaf() string {
+	if m.Delimiter == "" {
+		return m.Name
+	}
+	parts := strings.Split(m.Name, m.Delimiter)
+	return parts[len(parts)-1]
+}
+
+// Whether the mailbox has the given attribute.
+func (m Mailbox) Has(attribute string) bool {
+	for _, a := range m.Attributes {
+		if strings.EqualFold(a, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the mailbox can hold messages, versus only being a parent of other mailboxes.
+func (m Mailbox) Selectable() bool {
+	return !m.Has(`\Noselect`) && !m.Has(`\NonExistent`)
+}
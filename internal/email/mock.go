@@ -20,22 +20,22 @@ func NewMock() *Mock {
 		inbox: []MessageHeader{
 			{
 				ID:      1,
-				From:    "alice@example.com",
-				To:      []string{"bob@example.com"},
+				From:    Address{Address: "alice@example.com"},
+				To:      []Address{{Address: "bob@example.com"}},
 				Subject: "Hello World",
 				Date:    time.Now().Add(-time.Hour * 24),
 			},
 			{
 				ID:      2,
-				From:    "carol@example.com",
-				To:      []string{"alice@example.com", "bob@example.com"},
+				From:    Address{Address: "carol@example.com"},
+				To:      []Address{{Address: "alice@example.com"}, {Address: "bob@example.com"}},
 				Subject: "Meeting Tomorrow",
 				Date:    time.Now().Add(-time.Hour * 12),
 			},
 			{
 				ID:      3,
-				From:    "bob@example.com",
-				To:      []string{"alice@example.com"},
+				From:    Address{Address: "bob@example.com"},
+				To:      []Address{{Address: "alice@example.com"}},
 				Subject: "Re: Hello World",
 				Date:    time.Now().Add(-time.Hour * 6),
 			},
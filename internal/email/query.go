@@ -0,0 +1,191 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search queries.
+//
+// A query is a list of terms, all of which a message must match, e.g.
+//
+//	from:alice subject:"deploy failed" since:2025-01-01 is:unread has:attachment body:timeout
+//
+// Terms are written key:value, with the value quoted if it has spaces in it.
+// Terms without a key match anywhere in the message's headers or body.
+
+// The layout of dates in queries.
+const queryDateLayout = "2006-01-02"
+
+// Query is a parsed search query.
+type Query struct {
+	// Text each of which must appear in the named header.
+	From, To, Cc, Subject []string
+
+	// Text each of which must appear in the message's body.
+	Body []string
+
+	// Text each of which must appear anywhere in the message.
+	Text []string
+
+	// Only messages received on or after this day, if it is set.
+	Since time.Time
+
+	// Only messages received before this day, if it is set.
+	Before time.Time
+
+	// The flags the message must have, and those it mustn't.
+	WithFlags, WithoutFlags Flag
+
+	// Whether the message must have attachments.
+	HasAttachment bool
+}
+
+// The flags which can be searched for with is:, and whether the message must have or lack them.
+var queryFlags = map[string]struct {
+	flag Flag
+	on   bool
+}{
+	"read":       {Seen, true},
+	"unread":     {Seen, false},
+	"starred":    {Flagged, true},
+	"flagged":    {Flagged, true},
+	"unstarred":  {Flagged, false},
+	"answered":   {Answered, true},
+	"unanswered": {Answered, false},
+	"draft":      {Draft, true},
+}
+
+// ParseQuery parses a search query.
+// Unknown keys, values and dates are errors, so a typo doesn't quietly search for something else.
+func ParseQuery(text string) (Query, error) {
+	terms, err := splitQuery(text)
+	if err != nil {
+		return Query{}, err
+	}
+	if len(terms) == 0 {
+		return Query{}, fmt.Errorf("empty search")
+	}
+
+	var query Query
+	for _, term := range terms {
+		if term.key == "" {
+			query.Text = append(query.Text, term.value)
+			continue
+		}
+		if term.value == "" {
+			return Query{}, fmt.Errorf("nothing to search for after %s:", term.key)
+		}
+
+		switch term.key {
+		case "from":
+			query.From = append(query.From, term.value)
+		case "to":
+			query.To = append(query.To, term.value)
+		case "cc":
+			query.Cc = append(query.Cc, term.value)
+		case "subject":
+			query.Subject = append(query.Subject, term.value)
+		case "body":
+			query.Body = append(query.Body, term.value)
+		case "since", "before":
+			day, err := time.ParseInLocation(queryDateLayout, term.value, time.Local)
+			if err != nil {
+				return Query{}, fmt.Errorf("%s:%s is not a date like %s", term.key, term.value, queryDateLayout)
+			}
+			if term.key == "since" {
+				query.Since = day
+			} else {
+				query.Before = day
+			}
+		case "is":
+			is, ok := queryFlags[strings.ToLower(term.value)]
+			if !ok {
+				return Query{}, fmt.Errorf("unknown is:%s", term.value)
+			}
+			if is.on {
+				query.WithFlags |= is.flag
+			} else {
+				query.WithoutFlags |= is.flag
+			}
+		case "has":
+			if !strings.EqualFold(term.value, "attachment") {
+				return Query{}, fmt.Errorf("unknown has:%s", term.value)
+			}
+			query.HasAttachment = true
+		default:
+			return Query{}, fmt.Errorf("unknown search key %s:", term.key)
+		}
+	}
+	if query.WithFlags&query.WithoutFlags != 0 {
+		return Query{}, fmt.Errorf("a message can't both be and not be %s", flagNames(query.WithFlags&query.WithoutFlags))
+	}
+	return query, nil
+}
+
+// The is: names of the flags, for errors.
+func flagNames(flags Flag) string {
+	names := []string{}
+	for _, name := range []string{"read", "starred", "answered", "draft"} {
+		if flags.Has(queryFlags[name].flag) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// One key:value term of a query. Terms without keys have an empty key.
+type queryTerm struct {
+	key, value string
+}
+
+// Split a query into its terms, honouring double quotes.
+func splitQuery(text string) ([]queryTerm, error) {
+	terms := []queryTerm{}
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var term queryTerm
+		// A key is a run of letters ending in a colon.
+		start := i
+		for i < len(runes) && unicode.IsLetter(runes[i]) {
+			i++
+		}
+		if i < len(runes) && i > start && runes[i] == ':' {
+			term.key = strings.ToLower(string(runes[start:i]))
+			i++
+		} else {
+			i = start
+		}
+
+		value := new(strings.Builder)
+		if i < len(runes) && runes[i] == '"' {
+			i++
+			closed := false
+			for ; i < len(runes); i++ {
+				if runes[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				value.WriteRune(runes[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unclosed quote in search")
+			}
+		} else {
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]); i++ {
+				value.WriteRune(runes[i])
+			}
+		}
+		term.value = value.String()
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
@@ -0,0 +1,61 @@
+package email
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery(`from:alice subject:"deploy failed" since:2025-01-01 is:unread has:attachment body:timeout staging`)
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+
+	expected := Query{
+		From:          []string{"alice"},
+		Subject:       []string{"deploy failed"},
+		Body:          []string{"timeout"},
+		Text:          []string{"staging"},
+		Since:         time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local),
+		WithoutFlags:  Seen,
+		HasAttachment: true,
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, query)
+	}
+}
+
+func TestParseQueryQuotedText(t *testing.T) {
+	query, err := ParseQuery(`"quarterly report" is:starred TO:bob`)
+	if err != nil {
+		t.Fatalf("Failed to parse query: %v", err)
+	}
+	if !reflect.DeepEqual(query.Text, []string{"quarterly report"}) {
+		t.Errorf("Expected the quoted text as one term, got %q", query.Text)
+	}
+	if !reflect.DeepEqual(query.To, []string{"bob"}) {
+		t.Errorf("Expected keys to ignore case, got %q", query.To)
+	}
+	if !query.WithFlags.Has(Flagged) {
+		t.Errorf("Expected is:starred to require the Flagged flag")
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"   ",
+		"since:yesterday",
+		"is:shiny",
+		"has:pictures",
+		"colour:blue",
+		"from:",
+		`subject:"unclosed`,
+		"is:read is:unread",
+	} {
+		if _, err := ParseQuery(text); err == nil {
+			t.Errorf("Expected an error parsing %q", text)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Replying to and forwarding messages.
+// These build the draft to compose from, leaving the sending to the Sender.
+
+// The layout of dates in attribution lines and forwarded headers.
+const quoteDateLayout = "Mon, 2 Jan 2006 at 15:04"
+
+// Reply drafts a reply to msg, to be sent from the address self.
+// The reply goes to the message's Reply-To addresses if it has them, or else to its sender.
+// Replying to all also copies in everyone else the message went to.
+// We never address ourselves, unless we're replying to our own message, when it goes to its recipients.
+func Reply(msg Message, self string, all bool) Message {
+	recipients := msg.ReplyTo
+	if len(recipients) == 0 {
+		recipients = []Address{msg.From}
+	}
+	if len(withoutAddress(recipients, self)) == 0 {
+		recipients = msg.To
+	}
+	to := uniqueAddresses(withoutAddress(recipients, self))
+
+	var cc []Address
+	if all {
+		everyone := append(append(append([]Address{}, to...), msg.To...), msg.Cc...)
+		cc = uniqueAddresses(withoutAddress(everyone, self))[len(to):]
+	}
+
+	return Message{
+		MessageHeader: MessageHeader{
+			To:         to,
+			Cc:         cc,
+			Subject:    prefixSubject("Re:", msg.Subject),
+			InReplyTo:  msg.MessageID,
+			References: references(msg),
+		},
+		Body: fmt.Sprintf("\n\nOn %s, %s wrote:\n%s", msg.Date.Format(quoteDateLayout), msg.From, quote(msg.Body)),
+	}
+}
+
+// Forward drafts a forward of msg, with no one to send it to yet.
+// The original's headers and text go in the body.
+func Forward(msg Message) Message {
+	forwarded := []string{
+		"",
+		"",
+		"---------- Forwarded message ----------",
+		"From: " + msg.From.String(),
+		"Date: " + msg.Date.Format(quoteDateLayout),
+		"Subject: " + msg.Subject,
+		"To: " + FormatAddresses(msg.To),
+	}
+	if len(msg.Cc) > 0 {
+		forwarded = append(forwarded, "Cc: "+FormatAddresses(msg.Cc))
+	}
+	forwarded = append(forwarded, "", msg.Body)
+
+	return Message{
+		MessageHeader: MessageHeader{
+			Subject: prefixSubject("Fwd:", msg.Subject),
+		},
+		Body: strings.Join(forwarded, "\n"),
+	}
+}
+
+// Prefix a subject, unless it already has the prefix or one meaning the same.
+// That stops subjects growing "Re: Re: Re:" down a thread.
+func prefixSubject(prefix, subject string) string {
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	prefixes := []string{strings.ToLower(prefix)}
+	if prefix == "Fwd:" {
+		prefixes = append(prefixes, "fw:")
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(lower, p) {
+			return strings.TrimSpace(subject)
+		}
+	}
+	return prefix + " " + strings.TrimSpace(subject)
+}
+
+// The References for a reply to msg: its own references followed by its Message-ID.
+// Messages without References may still say what they reply to, which starts the chain instead.
+// See RFC 5322 section 3.6.4.
+func references(msg Message) []string {
+	refs := append([]string{}, msg.References...)
+	if len(refs) == 0 && msg.InReplyTo != "" {
+		refs = append(refs, msg.InReplyTo)
+	}
+	if msg.MessageID != "" {
+		refs = append(refs, msg.MessageID)
+	}
+	return refs
+}
+
+// Quote a body for a reply, prefixing each line with "> ".
+func quote(body string) string {
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	for i, line := range lines {
+		if line == "" || strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The bare address of someone, e.g. "flast@example.com" for "F Last <flast@example.com>", lower-cased.
+// Anything which doesn't parse is compared as it is.
+func bareAddress(s string) string {
+	if addr, err := ParseAddress(s); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// The recipients other than the given address.
+func withoutAddress(recipients []Address, address string) []Address {
+	self := Address{Address: bareAddress(address)}
+	others := []Address{}
+	for _, recipient := range recipients {
+		if !recipient.Is(self) {
+			others = append(others, recipient)
+		}
+	}
+	return others
+}
+
+// The recipients with any repeated addresses dropped, keeping the first of each.
+func uniqueAddresses(recipients []Address) []Address {
+	seen := map[string]bool{}
+	unique := []Address{}
+	for _, recipient := range recipients {
+		address := strings.ToLower(recipient.Address)
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+		unique = append(unique, recipient)
+	}
+	return unique
+}
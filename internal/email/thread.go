@@ -0,0 +1,211 @@
+package email
+
+import (
+	"sort"
+	"time"
+)
+
+// Conversation threading.
+//
+// Servers with the THREAD=REFERENCES extension thread mailboxes themselves; for the rest,
+// ThreadHeaders does the same from the Message-ID, In-Reply-To and References headers.
+// That is the first half of the algorithm at https://www.jwz.org/doc/threading.html:
+// messages are only grouped by what they reply to, never by a shared subject.
+
+// Thread is a message and the replies to it, which are threads in turn.
+type Thread struct {
+	// The message's ID, or 0 where the message isn't in the mailbox but its replies are.
+	ID int
+
+	// The replies to the message, oldest first.
+	Replies []Thread
+}
+
+// The number of messages in the thread, not counting missing ones.
+func (t Thread) Count() int {
+	count := 0
+	t.Walk(func(int, int) { count++ })
+	return count
+}
+
+// Visit every message in the thread, parents before their replies, with how deep in replies each is.
+// Missing messages are skipped, and their replies take their place.
+func (t Thread) Walk(visit func(id, depth int)) {
+	t.walk(visit, 0)
+}
+
+func (t Thread) walk(visit func(id, depth int), depth int) {
+	if t.ID != 0 {
+		visit(t.ID, depth)
+		depth++
+	}
+	for _, reply := range t.Replies {
+		reply.walk(visit, depth)
+	}
+}
+
+// A message, or a message we only know of by being referred to, while threading.
+type container struct {
+	header   *MessageHeader
+	parent   *container
+	children []*container
+}
+
+// Whether c is an ancestor of other, or other itself.
+func (c *container) isAncestorOf(other *container) bool {
+	for ; other != nil; other = other.parent {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Make c a child of parent, taking it from any parent it had.
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, sibling := range siblings {
+			if sibling == c {
+				c.parent.children = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	parent.children = append(parent.children, c)
+}
+
+// The threads the container stands for: one for a message, and those of its children for a missing one.
+func (c *container) threads() []Thread {
+	replies := []Thread{}
+	for _, child := range c.children {
+		replies = append(replies, child.threads()...)
+	}
+	if c.header == nil {
+		return replies
+	}
+	return []Thread{{ID: c.header.ID, Replies: replies}}
+}
+
+// ThreadHeaders groups messages into threads by what they reply to, newest conversation first.
+func ThreadHeaders(headers []MessageHeader) []Thread {
+	byMessageID := map[string]*container{}
+	containers := []*container{}
+	get := func(messageID string) *container {
+		c, ok := byMessageID[messageID]
+		if !ok {
+			c = &container{}
+			byMessageID[messageID] = c
+			containers = append(containers, c)
+		}
+		return c
+	}
+
+	for i := range headers {
+		header := &headers[i]
+		c, isKnown := byMessageID[header.MessageID]
+		if header.MessageID == "" || isKnown && c.header != nil {
+			// Messages without IDs, or with the ID of another, are threads of their own.
+			c = &container{}
+			containers = append(containers, c)
+		} else {
+			c = get(header.MessageID)
+		}
+		c.header = header
+
+		references := header.References
+		if len(references) == 0 && header.InReplyTo != "" {
+			references = []string{header.InReplyTo}
+		}
+
+		// Each reference replies to the one before, unless we already know better.
+		var parent *container
+		for _, messageID := range references {
+			reference := get(messageID)
+			if parent != nil && reference.parent == nil && !reference.isAncestorOf(parent) {
+				reference.setParent(parent)
+			}
+			parent = reference
+		}
+		// The message replies to the last of them, whatever else we thought.
+		if parent != nil && c.parent != parent && !c.isAncestorOf(parent) {
+			c.setParent(parent)
+		}
+	}
+
+	threads := []Thread{}
+	for _, c := range containers {
+		if c.parent != nil {
+			continue
+		}
+		switch roots := c.threads(); len(roots) {
+		case 0:
+		case 1:
+			threads = append(threads, roots[0])
+		default:
+			threads = append(threads, Thread{Replies: roots})
+		}
+	}
+	SortThreads(threads, headers)
+	return threads
+}
+
+// SortThreads puts the conversations with the newest messages first, and each thread's replies oldest first.
+// Messages without headers are ordered as though they're the oldest.
+func SortThreads(threads []Thread, headers []MessageHeader) {
+	dates := make(map[int]time.Time, len(headers))
+	for _, header := range headers {
+		dates[header.ID] = header.Date
+	}
+	for i := range threads {
+		sortReplies(&threads[i], dates)
+	}
+	type dated struct {
+		thread Thread
+		latest time.Time
+	}
+	byLatest := make([]dated, len(threads))
+	for i, thread := range threads {
+		byLatest[i].thread = thread
+		thread.Walk(func(id, _ int) {
+			if date := dates[id]; date.After(byLatest[i].latest) {
+				byLatest[i].latest = date
+			}
+		})
+	}
+	sort.SliceStable(byLatest, func(i, j int) bool {
+		return byLatest[i].latest.After(byLatest[j].latest)
+	})
+	for i := range byLatest {
+		threads[i] = byLatest[i].thread
+	}
+}
+
+// Order a thread's replies oldest first, all the way down.
+// Missing messages are dated by their first reply.
+func sortReplies(thread *Thread, dates map[int]time.Time) time.Time {
+	type dated struct {
+		thread   Thread
+		earliest time.Time
+	}
+	byEarliest := make([]dated, len(thread.Replies))
+	for i := range thread.Replies {
+		byEarliest[i].earliest = sortReplies(&thread.Replies[i], dates)
+		byEarliest[i].thread = thread.Replies[i]
+	}
+	sort.SliceStable(byEarliest, func(i, j int) bool {
+		return byEarliest[i].earliest.Before(byEarliest[j].earliest)
+	})
+	for i := range byEarliest {
+		thread.Replies[i] = byEarliest[i].thread
+	}
+
+	if thread.ID != 0 {
+		return dates[thread.ID]
+	}
+	if len(byEarliest) > 0 {
+		return byEarliest[0].earliest
+	}
+	return time.Time{}
+}
@@ -1,10 +1,14 @@
 package errorview
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/log"
 	"github.com/jcc333/jkm/internal/messages"
 )
@@ -13,15 +17,20 @@ import (
 type model struct {
 	cfg   *configure.Config
 	error string
+
+	// The untrusted certificate behind the error, if that's what it was, to show in full.
+	certificate *email.CertificateError
 }
 
 // New creates a new error model
 func New(cfg *configure.Config, err error) *model {
 	log.Info("new error model")
-	return &model{
+	m := &model{
 		cfg:   cfg,
 		error: err.Error(),
 	}
+	errors.As(err, &m.certificate)
+	return m
 }
 
 // Init initializes the error model
@@ -45,5 +54,26 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 // View renders the error model
 func (m *model) View() string {
 	log.Info("view error model")
+	if m.certificate != nil {
+		return fmt.Sprintf("Error: '%s'\n\n%s\nPress any key to return to the list view...", m.error, certificateView(m.certificate))
+	}
 	return fmt.Sprintf("Error: '%s'\n\nPress any key to return to the list view...", m.error)
 }
+
+// The certificates a server presented, and how to trust them if they should be.
+func certificateView(e *email.CertificateError) string {
+	view := new(strings.Builder)
+	fmt.Fprintf(view, "%s presented these certificates:\n\n", e.Host)
+	for i, cert := range e.Certificates {
+		fmt.Fprintf(view, "%d. Subject: %s\n", i+1, cert.Subject)
+		fmt.Fprintf(view, "   Issuer:  %s\n", cert.Issuer)
+		fmt.Fprintf(view, "   Valid:   %s to %s\n", cert.NotBefore.Format(time.DateOnly), cert.NotAfter.Format(time.DateOnly))
+		if len(cert.DNSNames) > 0 {
+			fmt.Fprintf(view, "   Names:   %s\n", strings.Join(cert.DNSNames, ", "))
+		}
+		fmt.Fprintf(view, "   SHA-256: %s\n\n", email.Fingerprint(cert))
+	}
+	view.WriteString("If you trust them, add their issuer to a PEM file named by JKM_CA_BUNDLE,\n")
+	view.WriteString("or pin the server's certificate by its SHA-256 fingerprint in JKM_PINNED_CERTS.\n")
+	return view.String()
+}
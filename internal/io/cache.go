@@ -0,0 +1,93 @@
+package io
+
+import (
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// Keeping the selected mailbox's headers in memory, and in step with the local cache on disk.
+
+// The header of a message fetched with its envelope, flags and references.
+func messageHeader(msg *imap.Message) jkmemail.MessageHeader {
+	header := envelopeHeader(msg.Envelope)
+	header.ID = int(msg.Uid)
+	header.Flags = fromIMAPFlags(msg.Flags)
+	header.References = parseReferences(msg.GetBody(referencesSection))
+	return header
+}
+
+// Forget the selected mailbox's headers, and sync on from the given state with any headers cached under it.
+func (c *Client) resetCache(state store.State) {
+	c.uidValidity = state.UIDValidity
+	c.uidNext = state.UIDNext
+	c.highestModSeq = state.HighestModSeq
+	c.uids = []uint32{}
+	c.headers = make(map[uint32]jkmemail.MessageHeader)
+	c.deleted = make(map[uint32]bool)
+	if c.store == nil || state.UIDValidity == 0 {
+		return
+	}
+
+	headers, err := c.store.Headers(c.mailbox, state.UIDValidity)
+	if err != nil {
+		log.Warnf("Failed to load cached headers of %s: %v", c.mailbox, err)
+		return
+	}
+	for _, header := range headers {
+		uid := uint32(header.ID)
+		c.headers[uid] = header
+		c.uids = append(c.uids, uid)
+	}
+}
+
+// Load the named mailbox from the local cache, reporting whether we have it cached.
+func (c *Client) loadCache(mailbox string) bool {
+	if c.store == nil {
+		return false
+	}
+	state, err := c.store.State(mailbox)
+	if err != nil {
+		log.Warnf("Failed to load cached state of %s: %v", mailbox, err)
+		return false
+	}
+	if state.UIDValidity == 0 {
+		return false
+	}
+
+	c.mailbox = mailbox
+	c.resetCache(state)
+	log.Infof("loaded %d cached messages of %s", len(c.uids), mailbox)
+	return true
+}
+
+// Update the local cache, if there is one.
+// The cache only saves trips to the server, so failing to update it is logged rather than returned.
+func (c *Client) updateCache(update func(s *store.Store) error) {
+	if c.store == nil {
+		return
+	}
+	if err := update(c.store); err != nil {
+		log.Warnf("Failed to update cache of %s: %v", c.mailbox, err)
+	}
+}
+
+// The headers of the cached messages in the selected mailbox, newest first.
+func (c *Client) cachedHeaders() []jkmemail.MessageHeader {
+	headers := make([]jkmemail.MessageHeader, 0, len(c.uids))
+	for _, uid := range c.uids {
+		if header, ok := c.headers[uid]; ok {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// The headers of the selected mailbox as last seen, without going to the server.
+func (c *Client) Cached() []jkmemail.MessageHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cachedHeaders()
+}
@@ -0,0 +1,346 @@
+package io
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+
+	"github.com/jcc333/jkm/internal/configure"
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// These are best run with -race, which is what they're for.
+
+// Logging is set up once, as idle connections dialled in the background may still be logging from earlier tests.
+var initLogging sync.Once
+
+// The configuration for an in-memory IMAP server holding a few messages, and the server's backend.
+func newTestServer(t *testing.T) (*configure.Config, *memory.Backend) {
+	initLogging.Do(func() { log.Init(false) })
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		body := bytes.NewBufferString("From: alice@example.com\r\nSubject: hello\r\n\r\nhi there")
+		if err := inbox.CreateMessage(nil, time.Now(), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := server.New(anyUsername{be})
+	s.AllowInsecureAuth = true
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+
+	return &configure.Config{
+		IMAPServer:   "127.0.0.1",
+		IMAPPort:     listener.Addr().(*net.TCPAddr).Port,
+		IMAPSecurity: configure.NoSecurity,
+		EmailAddress: "username@example.com",
+		IMAPPassword: "password",
+		CachePath:    filepath.Join(t.TempDir(), "cache.db"),
+	}, be
+}
+
+// The memory backend's one user, whatever they log in as.
+type anyUsername struct {
+	*memory.Backend
+}
+
+func (be anyUsername) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	return be.Backend.Login(info, "username", password)
+}
+
+// A client connected to a server from newTestServer.
+func newTestClient(t *testing.T) *Client {
+	cfg, _ := newTestServer(t)
+	return connectTestClient(t, cfg)
+}
+
+func connectTestClient(t *testing.T, cfg *configure.Config) *Client {
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect() })
+	return c
+}
+
+// Run each of the commands a few times over, all at once.
+func runConcurrently(commands map[string]func(i int) error, report func(name string, err error)) {
+	var wg sync.WaitGroup
+	for name, command := range commands {
+		wg.Add(1)
+		go func(name string, command func(i int) error) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if err := command(i); err != nil {
+					report(name, err)
+				}
+			}
+		}(name, command)
+	}
+	wg.Wait()
+}
+
+// The commands the application runs from its goroutines, on a message with the given ID.
+func commandsOn(c *Client, id int) map[string]func(i int) error {
+	return map[string]func(i int) error{
+		"List": func(i int) error {
+			_, err := c.List(i%2 == 0)
+			return err
+		},
+		"Read": func(i int) error {
+			_, err := c.Read(id)
+			return err
+		},
+		"CountMessages": func(i int) error {
+			_, err := c.CountMessages()
+			return err
+		},
+		"SetFlag": func(i int) error {
+			return c.SetFlag(id, jkmemail.Flagged, i%2 == 0)
+		},
+		"Search": func(i int) error {
+			_, err := c.Search(jkmemail.Query{Subject: []string{"hello"}})
+			return err
+		},
+		"Mailboxes": func(i int) error {
+			_, err := c.Mailboxes()
+			return err
+		},
+		"Threads": func(i int) error {
+			_, err := c.Threads()
+			return err
+		},
+		"Cached": func(i int) error {
+			c.Cached()
+			c.Selected()
+			return nil
+		},
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	c := newTestClient(t)
+	headers, err := c.List(true)
+	if err != nil || len(headers) < 5 {
+		t.Fatalf("List = %d headers, %v; want at least 5", len(headers), err)
+	}
+
+	runConcurrently(commandsOn(c, headers[0].ID), func(name string, err error) {
+		t.Errorf("%s: %v", name, err)
+	})
+
+	after, err := c.List(true)
+	if err != nil || len(after) != len(headers) {
+		t.Fatalf("List afterwards = %d headers, %v; want %d", len(after), err, len(headers))
+	}
+}
+
+func TestConcurrentCommandsWhileReconnecting(t *testing.T) {
+	c := newTestClient(t)
+	headers, err := c.List(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.drop(errors.New("dropped by the test"))
+	// Commands fail while the supervisor reconnects, but they mustn't race it.
+	runConcurrently(commandsOn(c, headers[0].ID), func(string, error) {})
+
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case update := <-c.Updates():
+			if changed, ok := update.(jkmemail.ConnectionChanged); ok && changed.State == jkmemail.Connected {
+				if _, err := c.List(true); err != nil {
+					t.Fatalf("List after reconnecting: %v", err)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatal("didn't reconnect")
+		}
+	}
+}
+
+func TestUntrustedCertificateStopsReconnecting(t *testing.T) {
+	c := newTestClient(t)
+	certErr := &jkmemail.CertificateError{Host: "127.0.0.1", Err: errors.New("signed by unknown authority")}
+
+	done := make(chan struct{})
+	go func() {
+		c.reconnect(certErr, make(chan struct{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("kept trying to reconnect to a server whose certificate can't be trusted")
+	}
+	for {
+		update := <-c.Updates()
+		if changed, ok := update.(jkmemail.ConnectionChanged); ok {
+			if changed.State != jkmemail.Offline || !errors.Is(changed.Err, certErr) {
+				t.Errorf("published %+v, want offline with the certificate error", changed)
+			}
+			return
+		}
+	}
+}
+
+func TestRefusedLoginStopsReconnecting(t *testing.T) {
+	cfg, _ := newTestServer(t)
+	c := connectTestClient(t, cfg)
+	// The idle connection logs in with the configuration too, so is let go before it changes.
+	c.mu.Lock()
+	c.unwatch()
+	c.mu.Unlock()
+	c.watching.Wait()
+	c.cfg.IMAPPassword = "revoked"
+
+	done := make(chan struct{})
+	go func() {
+		c.reconnect(errors.New("connection closed"), make(chan struct{}))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kept trying to log in with a password the server refuses")
+	}
+	for {
+		update := <-c.Updates()
+		if changed, ok := update.(jkmemail.ConnectionChanged); ok && changed.Retry.IsZero() {
+			if changed.State != jkmemail.Offline || changed.Err == nil || jkmemail.IsOffline(changed.Err) {
+				t.Errorf("published %+v, want offline with the refused login", changed)
+			}
+			break
+		}
+	}
+
+	// Connecting afresh with it fails outright, rather than starting to reconnect.
+	c.mu.Lock()
+	c.in, c.smtpAuth, c.isReconnecting = nil, nil, false
+	c.mu.Unlock()
+	if err := c.Connect(); err == nil || jkmemail.IsOffline(err) {
+		t.Errorf("Connect failed with %v, want the refused login", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isReconnecting {
+		t.Error("reconnecting after a refused login")
+	}
+}
+
+func TestCommandsWhileOffline(t *testing.T) {
+	cfg, _ := newTestServer(t)
+	cfg.CachePath = ""
+	c := connectTestClient(t, cfg)
+	// Reconnecting, with nothing of the mailbox to show meanwhile.
+	c.mu.Lock()
+	c.isReconnecting = true
+	c.resetCache(store.State{})
+	c.mu.Unlock()
+
+	if headers, err := c.List(true); err != nil || len(headers) != 0 {
+		t.Errorf("List = %d headers, %v; want none, without an error", len(headers), err)
+	}
+	if mailboxes, err := c.Mailboxes(); err != nil || len(mailboxes) != 0 {
+		t.Errorf("Mailboxes = %v, %v; want none, without an error", mailboxes, err)
+	}
+	if _, err := c.Search(jkmemail.Query{Subject: []string{"hello"}}); !jkmemail.IsOffline(err) {
+		t.Errorf("Search failed with %v, want it to be for being offline", err)
+	}
+}
+
+func TestReadKeepsHeaderAndSource(t *testing.T) {
+	c := newTestClient(t)
+	headers, err := c.List(true)
+	if err != nil || len(headers) == 0 {
+		t.Fatalf("List = %d headers, %v; want some", len(headers), err)
+	}
+	var id int
+	for _, header := range headers {
+		if header.Subject == "hello" {
+			id = header.ID
+		}
+	}
+
+	msg, err := c.Read(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg.RawHeader, "From: alice@example.com\r\nSubject: hello\r\n") {
+		t.Errorf("RawHeader = %q; want the message's header block", msg.RawHeader)
+	}
+
+	source, err := c.Source(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "From: alice@example.com\r\nSubject: hello\r\n\r\nhi there"; string(source) != want {
+		t.Errorf("Source = %q; want %q", source, want)
+	}
+}
+
+func TestMailboxesCountsSelectedWithoutStatus(t *testing.T) {
+	cfg, be := newTestServer(t)
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	c := connectTestClient(t, cfg)
+	headers, err := c.List(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unread := 0
+	for _, header := range headers {
+		if !header.Flags.Has(jkmemail.Seen) {
+			unread++
+		}
+	}
+
+	said := &transcript{}
+	c.mu.Lock()
+	c.in.SetDebug(said)
+	c.mu.Unlock()
+	mailboxes, err := c.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mailboxes) != 2 || mailboxes[0].Messages != len(headers) || mailboxes[0].Unread != unread {
+		t.Errorf("listed %+v, want INBOX with %d messages, %d unread, and Archive", mailboxes, len(headers), unread)
+	}
+	if got := said.String(); strings.Contains(got, "STATUS INBOX") || !strings.Contains(got, `STATUS "Archive"`) {
+		t.Errorf("asked for the status of the wrong mailboxes:\n%s", got)
+	}
+}
@@ -0,0 +1,125 @@
+package io
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Keeping drafts in the drafts mailbox.
+//
+// IMAP can't change a message, so saving a draft again appends a new copy and expunges the old ones,
+// which are found by the Message-ID every save of a draft shares.
+
+// Save a draft to the drafts mailbox, replacing any earlier save of it.
+func (c *Client) SaveDraft(draft jkmemail.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to save draft with subject %s: '%v'", draft.Subject, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	drafts, err := c.specialMailbox(c.cfg.DraftsMailbox, `\Drafts`, "Drafts")
+	if err != nil {
+		return err
+	}
+	raw, err := render(draft, c.cfg.EmailAddress, true)
+	if err != nil {
+		return err
+	}
+	log.Infof("saving draft %s to %s", draft.MessageID, drafts)
+	err = c.in.Append(drafts, []string{imap.DraftFlag, imap.SeenFlag}, time.Now(), bytes.NewBuffer(raw))
+	if err != nil {
+		return err
+	}
+	// The copy just appended has the highest UID, and is the one to keep.
+	err = c.removeDrafts(drafts, draft.MessageID, true)
+	return err
+}
+
+// Remove every save of a draft from the drafts mailbox.
+func (c *Client) DeleteDraft(draft jkmemail.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to delete draft with subject %s: '%v'", draft.Subject, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	drafts, err := c.specialMailbox(c.cfg.DraftsMailbox, `\Drafts`, "Drafts")
+	if err != nil {
+		return err
+	}
+	err = c.removeDrafts(drafts, draft.MessageID, false)
+	return err
+}
+
+// Expunge the saves of the draft with the given Message-ID from the drafts mailbox, keeping the newest if asked to.
+func (c *Client) removeDrafts(drafts, messageID string, keepNewest bool) error {
+	if messageID == "" {
+		return nil
+	}
+	// Working in the drafts mailbox means leaving the selected one for a moment.
+	if drafts != c.mailbox {
+		if _, err := c.in.Select(drafts, false); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := c.in.Select(c.mailbox, false); err != nil {
+				log.Warnf("Failed to select %s again: %v", c.mailbox, err)
+			}
+		}()
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Set("Message-Id", messageID)
+	uids, err := c.in.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if keepNewest && len(uids) > 0 {
+		uids = uids[:len(uids)-1]
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.in.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	expunged, err := c.expunge(seqSet)
+	if err != nil {
+		return err
+	}
+	if drafts == c.mailbox {
+		for _, uid := range uids {
+			if !expunged {
+				c.deleted[uid] = true
+			}
+			c.forget(uid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package io
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+)
+
+func TestSaveDraftReplacesEarlierSaves(t *testing.T) {
+	cfg, be := newTestServer(t)
+	c := connectTestClient(t, cfg)
+	draft := jkmemail.Message{
+		MessageHeader: jkmemail.MessageHeader{
+			To:        []jkmemail.Address{{Address: "bob@example.com"}},
+			Subject:   "plans",
+			MessageID: jkmemail.NewMessageID(cfg.EmailAddress),
+		},
+		Body: "first go",
+		Bcc:  []jkmemail.Address{{Address: "dave@example.com"}},
+	}
+
+	drafts := func() []*memory.Message {
+		user, err := be.Login(nil, "username", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mailbox, err := user.GetMailbox("Drafts")
+		if err != nil {
+			t.Fatalf("no Drafts mailbox: %v", err)
+		}
+		return mailbox.(*memory.Mailbox).Messages
+	}
+
+	if err := c.SaveDraft(draft); err != nil {
+		t.Fatalf("SaveDraft: %v", err)
+	}
+	draft.Body = "second go"
+	if err := c.SaveDraft(draft); err != nil {
+		t.Fatalf("SaveDraft again: %v", err)
+	}
+	saved := drafts()
+	if len(saved) != 1 {
+		t.Fatalf("%d drafts saved, want 1", len(saved))
+	}
+	if !hasIMAPFlag(saved[0].Flags, `\Draft`) {
+		t.Errorf("draft saved with flags %v, want \\Draft", saved[0].Flags)
+	}
+	if got := string(saved[0].Body); !strings.Contains(got, "second go") {
+		t.Errorf("draft saved as %q, want the second go", got)
+	}
+	// Drafts keep who they blind copy, for when they're resumed.
+	if got := string(saved[0].Body); !strings.Contains(got, "Bcc: <dave@example.com>") {
+		t.Errorf("draft saved as %q, want its Bcc", got)
+	}
+
+	if err := c.DeleteDraft(draft); err != nil {
+		t.Fatalf("DeleteDraft: %v", err)
+	}
+	if saved := drafts(); len(saved) != 0 {
+		t.Errorf("%d drafts left after deleting, want 0", len(saved))
+	}
+
+	// The selected mailbox is still the one we were in.
+	if _, err := c.List(true); err != nil {
+		t.Fatalf("List after saving drafts: %v", err)
+	}
+}
+
+func TestSaveDraftLeavesOthersDeleted(t *testing.T) {
+	cfg, be := newTestServer(t)
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CreateMailbox("Drafts"); err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := user.GetMailbox("Drafts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Marked deleted by another client, which hasn't expunged it yet.
+	body := bytes.NewBufferString("From: alice@example.com\r\nSubject: old\r\n\r\nnever mind")
+	if err := mailbox.CreateMessage([]string{imap.DraftFlag, imap.DeletedFlag}, time.Now(), body); err != nil {
+		t.Fatal(err)
+	}
+
+	c := connectTestClient(t, cfg)
+	if ok, err := c.in.Support("UIDPLUS"); err != nil || ok {
+		t.Fatalf("the test server supports UIDPLUS (%v), so can't test without it", err)
+	}
+	draft := jkmemail.Message{
+		MessageHeader: jkmemail.MessageHeader{
+			To:        []jkmemail.Address{{Address: "bob@example.com"}},
+			Subject:   "plans",
+			MessageID: jkmemail.NewMessageID(cfg.EmailAddress),
+		},
+		Body: "first go",
+	}
+	if err := c.SaveDraft(draft); err != nil {
+		t.Fatalf("SaveDraft: %v", err)
+	}
+	draft.Body = "second go"
+	if err := c.SaveDraft(draft); err != nil {
+		t.Fatalf("SaveDraft again: %v", err)
+	}
+
+	saved := mailbox.(*memory.Mailbox).Messages
+	if len(saved) != 3 {
+		t.Fatalf("%d messages in Drafts, want the other deleted one and both saves", len(saved))
+	}
+	if got := string(saved[0].Body); !strings.Contains(got, "never mind") {
+		t.Errorf("the other deleted message was expunged, Drafts starts with %q", got)
+	}
+	if !hasIMAPFlag(saved[1].Flags, imap.DeletedFlag) || hasIMAPFlag(saved[2].Flags, imap.DeletedFlag) {
+		t.Errorf("saves flagged %v and %v, want only the first marked deleted", saved[1].Flags, saved[2].Flags)
+	}
+}
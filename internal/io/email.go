@@ -1,11 +1,14 @@
 package io
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/smtp"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -15,6 +18,8 @@ import (
 	"github.com/jcc333/jkm/internal/configure"
 	jkmemail "github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/oauth"
+	"github.com/jcc333/jkm/internal/store"
 )
 
 // IMAP and SMTP functionality.
@@ -35,18 +40,74 @@ type Client struct {
 	smtpPassword string
 	smtpAuth     smtp.Auth
 
-	// UIDs of messages in the inbox.
+	// Access tokens to sign in with, if we sign in with OAuth2 rather than passwords.
+	oauth *oauth.Source
+
+	// The mailbox we list and read from.
+	mailbox string
+
+	// UIDs of messages in the selected mailbox.
 	uids []uint32
 
-	// Cached read emails.
-	messageInfos map[uint32]*imap.Message
+	// The selected mailbox's UIDVALIDITY, which the UIDs belong to.
+	// Zero until we've listed the mailbox, from the server or the local cache.
+	uidValidity uint32
+
+	// The selected mailbox's UIDNEXT and HIGHESTMODSEQ as of the last sync, to sync on from.
+	// Both are zero until the mailbox has been synced in full.
+	uidNext       uint32
+	highestModSeq uint64
+
+	// Whether QRESYNC is enabled on the connection, so that the server tells us which messages vanished.
+	qresync bool
+
+	// Cached headers of the messages in the selected mailbox, by UID.
+	headers map[uint32]jkmemail.MessageHeader
+
+	// UIDs of the messages in the selected mailbox which are marked \Deleted but not yet expunged.
+	// They're left out of the headers, but the server still counts them among its messages.
+	deleted map[uint32]bool
+
+	// The local cache of mail, or nil if there isn't one.
+	store *store.Store
 
 	// Last refreshed cache at.
 	lastRefreshed time.Time
+
+	// Mailbox updates pushed by the server over the idle connection.
+	updates chan jkmemail.Update
+
+	// Closed to stop watching for updates.
+	stopWatching chan struct{}
+
+	// The idle connections still open, or being dialled, so that disconnecting can wait for them to log out.
+	watching sync.WaitGroup
+
+	// Held by each command for as long as it uses the connection or the selected mailbox's state,
+	// so that commands from the application's goroutines take turns rather than interleaving on the connection.
+	// The exported methods take it, and the unexported ones expect it to be held.
+	mu sync.Mutex
+
+	// Whether the connection dropped and the supervisor is getting it back.
+	isReconnecting bool
+
+	// Closed to stop supervising the connection.
+	stopSupervising chan struct{}
+
+	// Reports of the connection being broken, for the supervisor.
+	dropped chan error
 }
 
 // Disconnect from the IMAP server.
 func (i *Client) Disconnect() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.unsupervise()
+	i.unwatch()
+	i.watching.Wait()
+	if i.store != nil {
+		i.store.Close()
+	}
 	if i.in == nil {
 		return nil
 	}
@@ -57,144 +118,189 @@ func (i *Client) Disconnect() error {
 // Get a new IMAP-based Sender.
 func New(cfg *configure.Config) (*Client, error) {
 	c := &Client{
-		cfg:          cfg,
-		messageInfos: make(map[uint32]*imap.Message),
+		cfg:     cfg,
+		mailbox: jkmemail.Inbox,
+		headers: make(map[uint32]jkmemail.MessageHeader),
+		deleted: make(map[uint32]bool),
+		updates: make(chan jkmemail.Update, 64),
+		dropped: make(chan error, 1),
+	}
+	if cfg.UsesOAuth() {
+		// Before anything else, as this may need the user to authorize us.
+		c.oauth = oauth.New(cfg, os.Stderr)
+		ctx, cancel := context.WithTimeout(context.Background(), authorizeTimeout)
+		err := c.oauth.Authorize(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("Failed to sign in with OAuth2: %v", err)
+			return nil, err
+		}
 	}
-	err := c.Connect()
-	if err != nil {
-		log.Errorf("Failed to connect to IMAP server: %v", err)
-		return nil, err
+	if cfg.CachePath != "" {
+		s, err := store.Open(cfg.CachePath)
+		if err != nil {
+			log.Warnf("Failed to open cache at %s, carrying on without it: %v", cfg.CachePath, err)
+		} else {
+			c.store = s
+		}
+	}
+
+	// With the mailbox cached, connecting can wait until the mail is asked for.
+	if c.loadCache(c.mailbox) {
+		return c, nil
 	}
-	err = c.FetchMessages()
+	c.mu.Lock()
+	err := c.connect()
+	c.mu.Unlock()
 	if err != nil {
-		log.Errorf("Failed to fetch messages: %v", err)
+		log.Errorf("Failed to connect to IMAP server: %v", err)
 		return nil, err
 	}
 	return c, nil
 }
 
-// Connect to the IMAP server.
-func (c *Client) Connect() error {
-	var err error
-	defer func() {
-		if err != nil {
-			log.Errorf("Failed to connect to IMAP server: %v", err)
-			c.in = nil
-		}
-	}()
+// Dial and log in to the IMAP server on a fresh connection.
+func (c *Client) dial() (*imapClient.Client, error) {
+	conn, err := c.dialIMAP()
+	if err != nil {
+		return nil, err
+	}
 
-	if c.in != nil && c.smtpAuth != nil {
-		return nil
+	if err := c.login(conn); err != nil {
+		conn.Logout()
+		return nil, err
 	}
+	return conn, nil
+}
 
-	imapAddr := fmt.Sprintf("%s:%d", c.cfg.IMAPServer, c.cfg.IMAPPort)
-	c.in, err = imapClient.DialTLS(imapAddr, &tls.Config{InsecureSkipVerify: true})
+// Log in on a fresh connection, with the password or an access token as configured.
+func (c *Client) login(conn *imapClient.Client) error {
+	if c.oauth == nil {
+		return conn.Login(c.cfg.EmailAddress, c.cfg.IMAPPassword)
+	}
+	token, err := c.accessToken()
 	if err != nil {
 		return err
 	}
+	return conn.Authenticate(oauth.SASLClient(c.cfg.Auth, c.cfg.EmailAddress, token, c.cfg.IMAPServer, c.cfg.IMAPPort))
+}
 
-	if err := c.in.Login(c.cfg.EmailAddress, c.cfg.IMAPPassword); err != nil {
-		return err
-	}
+// A valid OAuth2 access token, refreshed if need be.
+func (c *Client) accessToken() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return c.oauth.Token(ctx)
+}
 
-	err = c.FetchMessages()
+// How the SMTP server is signed in to, with the password or a fresh access token as configured.
+func (c *Client) smtpAuthentication() (smtp.Auth, error) {
+	if c.oauth == nil {
+		return smtp.PlainAuth("", c.smtpEmail, c.smtpPassword, c.smtpServer), nil
+	}
+	token, err := c.accessToken()
 	if err != nil {
-		log.Errorf("Failed to fetch messages: %v", err)
-		return err
+		return nil, err
 	}
+	return oauth.SMTPAuth(oauth.SASLClient(c.cfg.Auth, c.smtpEmail, token, c.smtpServer, c.smtpPort)), nil
+}
 
-	// Setup SMTP configuration
-	c.smtpServer = c.cfg.SMTPServer
-	c.smtpPort = c.cfg.SMTPPort
-	c.smtpEmail = c.cfg.EmailAddress
-	c.smtpPassword = c.cfg.SMTPPassword
-	c.smtpAuth = smtp.PlainAuth("", c.smtpEmail, c.smtpPassword, c.smtpServer)
-
-	return nil
+// Connect to the IMAP server, if we aren't already.
+// If we can't, the supervisor keeps trying in the background, and until it succeeds this fails fast.
+func (c *Client) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ensureConnected()
 }
 
-// Refresh the cached inbox contents
-func (c *Client) FetchMessages() error {
-	var err error
-	defer func() {
-		c.lastRefreshed = time.Now()
-		if err != nil {
-			log.Errorf("Failed to fetch messages: %v", err)
-		}
-	}()
-	if c.in == nil {
-		err = fmt.Errorf("Fetching before connected to IMAP server")
-		return err
+// Connect to the IMAP server if we aren't already, starting the supervisor if we can't reach it.
+// Anything else, like the server refusing to log us in, won't mend by itself, so is only returned:
+// trying again and again could get the account locked.
+func (c *Client) ensureConnected() error {
+	if c.isReconnecting || c.in != nil && c.in.State() == imap.LogoutState {
+		return errReconnecting
 	}
 
-	mailbox, err := c.in.Select("INBOX", false)
-	if err != nil {
+	err := c.connect()
+	if err == nil || !isConnectionError(err) {
 		return err
 	}
+	err = fmt.Errorf("%w: %w", jkmemail.ErrOffline, err)
+	c.isReconnecting = true
+	c.unsupervise()
+	stop := make(chan struct{})
+	c.stopSupervising = stop
+	go c.reconnect(err, stop)
+	return err
+}
 
-	// Get all message sequence numbers (not UIDs) in descending order (newest first)
-	// This will use message sequence numbers, which are sorted by arrival time
-	if mailbox.Messages == 0 {
-		c.uids = []uint32{}
-	} else {
-		// Create sequence set for all messages - we'll later sort them in newest-first order
-		seqSet := new(imap.SeqSet)
-		// From 1 to highest message sequence number
-		seqSet.AddRange(1, mailbox.Messages)
-
-		// Load all UIDs
-		ids, err := c.in.UidSearch(&imap.SearchCriteria{
-			WithoutFlags: []string{imap.DeletedFlag},
-		})
-		if err != nil {
-			return err
-		}
-
-		// Sort the UIDs in descending order
-		if len(ids) > 1 {
-			for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
-				ids[i], ids[j] = ids[j], ids[i]
-			}
-		}
-		c.uids = ids
+// Connect to the IMAP server, if we aren't already, and supervise the new connection.
+// Must be called with mu held.
+func (c *Client) connect() error {
+	if c.in != nil && c.smtpAuth != nil {
+		return nil
 	}
 
-	seqSet := new(imap.SeqSet)
-	for _, uid := range c.uids {
-		seqSet.AddNum(uid)
+	conn, err := c.dial()
+	if err != nil {
+		log.Errorf("Failed to connect to IMAP server: %v", err)
+		return err
 	}
+	return c.setUp(conn)
+}
 
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags}
-	messages := make(chan *imap.Message, 100)
-	done := make(chan error, 1)
-
-	go func() {
-		done <- c.in.UidFetch(seqSet, items, messages)
+// Make a freshly dialled connection ours, syncing the selected mailbox on it, and supervise it.
+// Must be called with mu held.
+func (c *Client) setUp(conn *imapClient.Client) error {
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to connect to IMAP server: %v", err)
+			// Logged in but of no use, so not to be left open.
+			conn.Logout()
+			c.in = nil
+		}
 	}()
 
-	// Clear the cache before populating with fresh data
-	c.messageInfos = make(map[uint32]*imap.Message)
+	c.in = conn
+	c.qresync = c.enableQResync()
 
-	// Store all messages in our cache
-	for msg := range messages {
-		c.messageInfos[msg.Uid] = msg
+	err = c.fetchMessages()
+	if err != nil {
+		log.Errorf("Failed to fetch messages: %v", err)
+		return err
 	}
 
-	if err := <-done; err != nil {
+	// Setup SMTP configuration
+	c.smtpServer = c.cfg.SMTPServer
+	c.smtpPort = c.cfg.SMTPPort
+	c.smtpEmail = c.cfg.EmailAddress
+	c.smtpPassword = c.cfg.SMTPPassword
+	c.smtpAuth, err = c.smtpAuthentication()
+	if err != nil {
 		return err
 	}
 
+	// A fresh connection gets a fresh idle connection beside it, in case the old one went down with it.
+	c.watch(c.mailbox)
+	c.supervise(c.in)
 	return nil
 }
 
-// Count the number of messages in the IMAP server.
+// Count the number of messages in the selected mailbox.
 func (c *Client) CountMessages() (int, error) {
-	err := c.Connect()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.countMessages()
+}
+
+// Count the number of messages in the selected mailbox, without taking turns.
+func (c *Client) countMessages() (int, error) {
+	err := c.ensureConnected()
 	if err != nil {
 		log.Errorf("Failed to fetch message count: %v", err)
 		return 0, err
 	}
-	mailbox, err := c.in.Select("INBOX", false)
+	mailbox, err := c.in.Select(c.mailbox, false)
 	if err != nil {
 		return 0, err
 	}
@@ -203,184 +309,339 @@ func (c *Client) CountMessages() (int, error) {
 
 // Get all messages from the IMAP server.
 // TODO: Implement pagination for large mailboxes.
-// TODO: This does double-duty as a cache-buster/refresh function.
-// Ideally we'd use IDLE instead, but this is adequate for now.
+// This does double-duty as a cache-buster/refresh function when the idle connection reports changes.
 func (c *Client) List(shouldBustCache bool) ([]jkmemail.MessageHeader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	log.Info("io list messages")
-	err := c.Connect()
+	err := c.ensureConnected()
+	if err != nil {
+		// What we last saw of the mailbox, if anything, is better than an error while offline,
+		// which the status bar shows anyway.
+		if jkmemail.IsOffline(err) {
+			log.Warnf("Listing %s from the cache while offline: %v", c.mailbox, err)
+			return c.cachedHeaders(), nil
+		}
+		return nil, err
+	}
 	defer func() {
 		if err != nil {
 			log.Errorf("Failed to list messages: %v", err)
-			c.in = nil
+			if isConnectionError(err) {
+				c.drop(err)
+			}
 		}
 	}()
-	if err != nil {
-		return nil, err
-	}
 
-	// Refresh the list of UIDs
-	count, err := c.CountMessages()
+	// Refresh the list of UIDs, from the one SELECT.
+	// The server counts messages marked deleted, which we leave out of the headers.
+	mailbox, err := c.in.Select(c.mailbox, false)
 	if err != nil {
 		return nil, err
 	}
-	if count != len(c.messageInfos) || time.Since(c.lastRefreshed) > time.Second*30 || shouldBustCache {
-		err = c.FetchMessages()
+	if int(mailbox.Messages) != len(c.headers)+len(c.deleted) || time.Since(c.lastRefreshed) > time.Second*30 || shouldBustCache {
+		err = c.syncMessages(mailbox)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if len(c.uids) == 0 {
-		return []jkmemail.MessageHeader{}, nil
-	}
-
-	headers := make([]jkmemail.MessageHeader, 0, len(c.uids))
-	for _, uid := range c.uids {
-		msg, ok := c.messageInfos[uid]
-		if !ok || msg == nil || msg.Envelope == nil {
-			continue
-		}
+	return c.cachedHeaders(), nil
+}
 
-		var from string
-		if len(msg.Envelope.From) > 0 {
-			addr := msg.Envelope.From[0]
-			from = fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
-		}
+// Fetch a single message's items by UID.
+func (c *Client) fetchOne(uid uint32, items []imap.FetchItem) (*imap.Message, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
 
-		to := make([]string, 0, len(msg.Envelope.To))
-		for _, addr := range msg.Envelope.To {
-			to = append(to, fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName))
-		}
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.in.UidFetch(seqSet, items, messages)
+	}()
 
-		headers = append(headers, jkmemail.MessageHeader{
-			ID:      int(uid),
-			Subject: msg.Envelope.Subject,
-			Date:    msg.Envelope.Date,
-			From:    from,
-			To:      to,
-		})
+	msg := <-messages
+	if err := <-done; err != nil {
+		return nil, err
 	}
-
-	return headers, nil
+	if msg == nil {
+		return nil, fmt.Errorf("message %d not found", uid)
+	}
+	return msg, nil
 }
 
-// Get a single message from the IMAP server.
+// Get a single message, from the local cache if it's been read before or else from the IMAP server.
+// Only the message's text parts are fetched, and those are decoded for display.
 func (c *Client) Read(id int) (*jkmemail.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	var err error
 	defer func() {
 		if err != nil {
 			log.Errorf("Failed to read email with id %d: '%v'", id, err)
 		}
 	}()
-	err = c.Connect()
+	var fromCache *jkmemail.Message
+	if c.store != nil && c.uidValidity != 0 {
+		cached, cacheErr := c.store.Message(c.mailbox, c.uidValidity, id)
+		if cacheErr != nil {
+			log.Warnf("Failed to read email with id %d from the cache: %v", id, cacheErr)
+		} else if cached != nil {
+			// The cached flags may be behind the list's, which were fetched more recently.
+			if header, ok := c.headers[uint32(id)]; ok {
+				cached.Flags = header.Flags
+			}
+			fromCache = cached
+		}
+	}
+	// Messages cached before their header block was kept are fetched again for it, while we can.
+	if fromCache != nil && fromCache.RawHeader != "" {
+		return fromCache, nil
+	}
+
+	err = c.ensureConnected()
 	if err != nil {
+		if fromCache != nil {
+			log.Warnf("Showing the cached email with id %d without its full header: %v", id, err)
+			err = nil
+			return fromCache, nil
+		}
 		return nil, err
 	}
 
 	uid := uint32(id)
+	// The envelope has everything for a reply but the References, which we take from the header block fetched alongside it.
+	msg, err := c.fetchOne(uid, []imap.FetchItem{
+		imap.FetchEnvelope, imap.FetchFlags, imap.FetchBodyStructure, headerSection.FetchItem(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var rawHeader []byte
+	if r := msg.GetBody(headerSection); r != nil {
+		rawHeader, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+	textParts := findTextParts(msg.BodyStructure)
+	parts := make([]jkmemail.Part, 0, len(textParts))
+	if len(textParts) > 0 {
+		items := make([]imap.FetchItem, len(textParts))
+		for i, part := range textParts {
+			items[i] = part.section().FetchItem()
+		}
+		var bodies *imap.Message
+		bodies, err = c.fetchOne(uid, items)
+		if err != nil {
+			return nil, err
+		}
 
-	section := &imap.BodySectionName{
-		BodyPartName: imap.BodyPartName{
-			Specifier: imap.TextSpecifier,
-		},
-		Peek: true,
+		for _, part := range textParts {
+			r := bodies.GetBody(part.section())
+			if r == nil {
+				err = fmt.Errorf("unable to get part %s of message body", part.id())
+				return nil, err
+			}
+			var content string
+			content, err = decodePart(part, r)
+			if err != nil {
+				err = fmt.Errorf("failed to decode part %s of message body: %w", part.id(), err)
+				return nil, err
+			}
+			parts = append(parts, jkmemail.Part{
+				ID:       part.id(),
+				MIMEType: part.mimeType(),
+				Content:  content,
+			})
+		}
 	}
 
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchBody, imap.FetchBodyStructure, section.FetchItem()}
-	messages := make(chan *imap.Message, 1)
-	done := make(chan error, 1)
-	go func() {
-		done <- c.in.UidFetch(seqSet, items, messages)
-	}()
+	msg.Uid = uid
+	message := &jkmemail.Message{
+		MessageHeader: messageHeader(msg),
+		Body:          displayBody(parts),
+		Parts:         parts,
+		Attachments:   findAttachments(msg.BodyStructure),
+		RawHeader:     string(rawHeader),
+		// Only drafts of our own have a Bcc to show.
+		Bcc: addresses(msg.Envelope.Bcc),
+	}
+	message.References = parseReferences(bytes.NewReader(rawHeader))
+	c.updateCache(func(s *store.Store) error {
+		return s.PutMessage(c.mailbox, c.uidValidity, message)
+	})
+	return message, nil
+}
 
-	msg := <-messages
-	if msg == nil {
-		return nil, fmt.Errorf("message %d not found", id)
+// Fetch and decode one attachment of a message.
+// Attachments are only fetched when asked for, so large files don't slow down reading.
+func (c *Client) ReadAttachment(id int, attachment jkmemail.Attachment) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to read attachment %s of email with id %d: '%v'", attachment.PartID, id, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return nil, err
 	}
 
-	if err := <-done; err != nil {
+	path, err := parsePartID(attachment.PartID)
+	if err != nil {
+		return nil, err
+	}
+	// The encoding is only given by the body structure, so fetch that alongside the part.
+	section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: path}, Peek: true}
+	uid := uint32(id)
+	msg, err := c.fetchOne(uid, []imap.FetchItem{imap.FetchBodyStructure, section.FetchItem()})
+	if err != nil {
 		return nil, err
 	}
 
-	var body string
+	var encoding string
+	msg.BodyStructure.Walk(func(partPath []int, part *imap.BodyStructure) bool {
+		if partID(partPath) == attachment.PartID {
+			encoding = part.Encoding
+			return false
+		}
+		return true
+	})
+
 	r := msg.GetBody(section)
 	if r == nil {
-		return nil, fmt.Errorf("unable to get message body")
-	}
-	buf := new(strings.Builder)
-	if _, err := io.Copy(buf, r); err != nil {
-		return nil, fmt.Errorf("failed to read message body: %w", err)
+		err = fmt.Errorf("unable to get attachment %s", attachment.PartID)
+		return nil, err
 	}
-	body = buf.String()
+	content, err := decodeAttachment(encoding, r)
+	return content, err
+}
 
-	var from string
-	if len(msg.Envelope.From) > 0 {
-		addr := msg.Envelope.From[0]
-		from = fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName)
+// Fetch the whole of a message as it was sent, for showing its source.
+// The source isn't cached, as it's rarely wanted and may be large.
+func (c *Client) Source(id int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to read the source of email with id %d: '%v'", id, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return nil, err
 	}
 
-	to := make([]string, 0, len(msg.Envelope.To))
-	for _, addr := range msg.Envelope.To {
-		to = append(to, fmt.Sprintf("%s <%s@%s>", addr.PersonalName, addr.MailboxName, addr.HostName))
+	msg, err := c.fetchOne(uint32(id), []imap.FetchItem{sourceSection.FetchItem()})
+	if err != nil {
+		return nil, err
 	}
-
-	return &jkmemail.Message{
-		MessageHeader: jkmemail.MessageHeader{
-			ID:      id,
-			From:    from,
-			To:      to,
-			Subject: msg.Envelope.Subject,
-			Date:    msg.Envelope.Date,
-		},
-		Body: body,
-	}, nil
+	r := msg.GetBody(sourceSection)
+	if r == nil {
+		err = fmt.Errorf("unable to get the source of message %d", id)
+		return nil, err
+	}
+	source, err := io.ReadAll(r)
+	return source, err
 }
 
 // Send an email via SMTP.
 func (c *Client) Send(msg jkmemail.Message) error {
-	err := c.Connect()
+	var err error
 	defer func() {
 		if err != nil {
 			log.Warnf("Failed to send email with subject %s: '%v'", msg.Subject, err)
 		}
 	}()
 
+	// Only the SMTP settings need our turn; the sending itself needn't hold up the IMAP commands.
+	c.mu.Lock()
+	err = c.ensureConnected()
 	if err != nil {
+		c.mu.Unlock()
 		return fmt.Errorf("connection error: %w", err)
 	}
+	from, server, port := c.smtpEmail, c.smtpServer, c.smtpPort
+	// Access tokens expire, so each message gets a fresh one.
+	auth, err := c.smtpAuthentication()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Rendered once, so that the copy we keep is byte for byte what was sent.
+	raw, err := render(msg, from, false)
+	if err != nil {
+		return err
+	}
+	// Blind copies go in the envelope alone, which is how their recipients get the message without anyone seeing them.
+	recipients := append(append(append([]jkmemail.Address{}, msg.To...), msg.Cc...), msg.Bcc...)
+	err = c.deliver(server, port, auth, from, jkmemail.BareAddresses(recipients), raw)
+	if err != nil {
+		return err
+	}
 
+	if c.cfg.SaveSent {
+		// The message is gone either way, so failing to keep a copy isn't failing to send it.
+		if saveErr := c.saveSent(raw); saveErr != nil {
+			log.Warnf("Sent email with subject %s, but failed to save a copy: %v", msg.Subject, saveErr)
+		}
+	}
+	return nil
+}
+
+// Render a message from the given address as RFC 5322 bytes, for sending or saving.
+// The Bcc header is only for drafts, as anything else with it would tell everyone who was blind copied.
+func render(msg jkmemail.Message, from string, withBcc bool) ([]byte, error) {
 	m := email.NewEmail()
-	m.From = c.smtpEmail
-	m.To = msg.To
+	m.From = from
+	for _, to := range msg.To {
+		m.To = append(m.To, to.Header())
+	}
+	for _, cc := range msg.Cc {
+		m.Cc = append(m.Cc, cc.Header())
+	}
+	if withBcc && len(msg.Bcc) > 0 {
+		bcc := make([]string, len(msg.Bcc))
+		for i, addr := range msg.Bcc {
+			bcc[i] = addr.Header()
+		}
+		m.Headers.Set("Bcc", strings.Join(bcc, ", "))
+	}
 	m.Subject = msg.Subject
 	m.Text = []byte(msg.Body)
-
-	addr := fmt.Sprintf("%s:%d", c.smtpServer, c.smtpPort)
-	c.smtpAuth = smtp.PlainAuth("", c.smtpEmail, c.smtpPassword, c.smtpServer)
-	tlsConfig := &tls.Config{
-		ServerName:         c.smtpServer,
-		InsecureSkipVerify: false,
+	// Without one of ours, the email package makes up a new Message-ID each time.
+	if msg.MessageID != "" {
+		m.Headers.Set("Message-Id", msg.MessageID)
 	}
-
-	// Try TLS first (for port 465)
-	if c.smtpPort == 465 {
-		err = m.SendWithTLS(addr, c.smtpAuth, tlsConfig)
-		if err == nil {
-			return nil
+	// Threading headers keep replies with what they reply to in everyone's clients.
+	if msg.InReplyTo != "" {
+		m.Headers.Set("In-Reply-To", msg.InReplyTo)
+	}
+	if len(msg.References) > 0 {
+		m.Headers.Set("References", strings.Join(msg.References, " "))
+	}
+	for _, attachment := range msg.Attachments {
+		if err := attach(m, attachment); err != nil {
+			return nil, fmt.Errorf("attaching %s: %w", attachment.Filename, err)
 		}
-		fmt.Printf("TLS error: %v\n", err)
 	}
+	return m.Bytes()
+}
 
-	// Try StartTLS (for port 587)
-	err = m.SendWithStartTLS(addr, c.smtpAuth, tlsConfig)
-	if err == nil {
-		return nil
+// Attach a local file to an outgoing email, which makes it multipart/mixed.
+func attach(m *email.Email, attachment jkmemail.Attachment) error {
+	file, err := os.Open(attachment.Path)
+	if err != nil {
+		return err
 	}
-	fmt.Printf("StartTLS error: %v\n", err)
+	defer file.Close()
 
-	// Fallback to unencrypted
-	return m.Send(addr, c.smtpAuth)
+	_, err = m.Attach(file, attachment.Filename, attachment.MIMEType)
+	return err
 }
@@ -0,0 +1,70 @@
+package io
+
+import (
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// Message flags.
+
+// The IMAP system flag for each of our flags.
+var imapFlags = map[jkmemail.Flag]string{
+	jkmemail.Seen:     imap.SeenFlag,
+	jkmemail.Flagged:  imap.FlaggedFlag,
+	jkmemail.Answered: imap.AnsweredFlag,
+	jkmemail.Draft:    imap.DraftFlag,
+}
+
+// Our flags from the flags the server reports; any we don't track are ignored.
+func fromIMAPFlags(flags []string) jkmemail.Flag {
+	var result jkmemail.Flag
+	for _, name := range flags {
+		for flag, imapFlag := range imapFlags {
+			if imap.CanonicalFlag(name) == imapFlag {
+				result |= flag
+			}
+		}
+	}
+	return result
+}
+
+// Set or clear a flag on a message in the selected mailbox.
+func (c *Client) SetFlag(id int, flag jkmemail.Flag, on bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to set flag %d to %v on email with id %d: '%v'", flag, on, id, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	var op imap.FlagsOp = imap.AddFlags
+	if !on {
+		op = imap.RemoveFlags
+	}
+	uid := uint32(id)
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	err = c.in.UidStore(seqSet, imap.FormatFlagsOp(op, true), []interface{}{imapFlags[flag]}, nil)
+	if err != nil {
+		return err
+	}
+
+	// Keep the cache in step, rather than refetching.
+	if header, ok := c.headers[uid]; ok {
+		header.Flags = header.Flags.With(flag, on)
+		c.headers[uid] = header
+		c.updateCache(func(s *store.Store) error {
+			return s.SetFlags(c.mailbox, c.uidValidity, id, header.Flags)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package io
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Message headers, from the envelope and the few header fields it leaves out.
+
+// The References header field, which the envelope doesn't include.
+var referencesSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"References"},
+	},
+	Peek: true,
+}
+
+// The whole header block of a message, which is kept to show every header field.
+var headerSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+	Peek:         true,
+}
+
+// The whole of a message, as it was sent.
+var sourceSection = &imap.BodySectionName{Peek: true}
+
+// The header of a message as given by its envelope.
+// The envelope's names and subject are decoded already, except for encoded-words whose charset spoiled the rest.
+func envelopeHeader(envelope *imap.Envelope) jkmemail.MessageHeader {
+	var from jkmemail.Address
+	if addrs := addresses(envelope.From); len(addrs) > 0 {
+		from = addrs[0]
+	}
+	return jkmemail.MessageHeader{
+		From:      from,
+		To:        addresses(envelope.To),
+		Cc:        addresses(envelope.Cc),
+		ReplyTo:   addresses(envelope.ReplyTo),
+		Subject:   jkmemail.DecodeHeader(envelope.Subject),
+		Date:      envelope.Date,
+		MessageID: envelope.MessageId,
+		InReplyTo: envelope.InReplyTo,
+	}
+}
+
+// The addresses in an envelope's list, e.g. its To.
+func addresses(addrs []*imap.Address) []jkmemail.Address {
+	list := make([]jkmemail.Address, 0, len(addrs))
+	for _, addr := range addrs {
+		// Group syntax shows up as addresses without hosts, which mark where groups start and end rather than anyone to write to.
+		if addr.HostName == "" {
+			continue
+		}
+		list = append(list, jkmemail.Address{Name: jkmemail.DecodeHeader(addr.PersonalName), Address: addr.Address()})
+	}
+	return list
+}
+
+// Parse the Message-IDs out of a fetched References header field.
+// A missing or malformed field just means no references.
+func parseReferences(r io.Reader) []string {
+	if r == nil {
+		return nil
+	}
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		if err != io.EOF {
+			log.Warnf("Failed to parse References: %v", err)
+		}
+		return nil
+	}
+	return strings.Fields(header.Get("References"))
+}
@@ -0,0 +1,129 @@
+package io
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapClient "github.com/emersion/go-imap/client"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Push updates from the IMAP server.
+//
+// We keep a second connection to the server which does nothing but IDLE on the selected mailbox.
+// The server tells us about new, expunged and re-flagged messages on it,
+// and we translate those into `jkmemail.Update`s for the application.
+// Servers without the IDLE capability get polled with NOOP instead, which yields the same updates.
+
+// How often to poll with NOOP when the server can't IDLE.
+const pollInterval = 30 * time.Second
+
+// The updates pushed by the server.
+func (c *Client) Updates() <-chan jkmemail.Update {
+	return c.updates
+}
+
+// Watch the named mailbox for updates, in place of whatever was watched before.
+// The idle connection is dialled in the background, as commands shouldn't wait on a second connection.
+// Must be called with mu held.
+func (c *Client) watch(name string) {
+	c.unwatch()
+	stop := make(chan struct{})
+	c.stopWatching = stop
+	c.watching.Add(1)
+	go func() {
+		defer c.watching.Done()
+		c.idle(name, stop)
+	}()
+}
+
+// Open the idle connection on the named mailbox and translate its updates until told to stop.
+func (c *Client) idle(name string, stop <-chan struct{}) {
+	conn, err := c.dial()
+	if err != nil {
+		log.Warnf("Failed to watch %s for updates: %v", name, err)
+		return
+	}
+	defer conn.Logout()
+
+	// The client blocks while this is full, so it is drained in its own goroutine.
+	serverUpdates := make(chan imapClient.Update, 64)
+	conn.Updates = serverUpdates
+
+	mailbox, err := conn.Select(name, true)
+	if err != nil {
+		log.Warnf("Failed to watch %s for updates: %v", name, err)
+		return
+	}
+	select {
+	case <-stop:
+		// We moved on while dialling.
+		return
+	default:
+	}
+
+	go c.translate(name, conn, serverUpdates, stop, mailbox.Messages)
+	log.Infof("idling on %s", name)
+	err = conn.Idle(stop, &imapClient.IdleOptions{PollInterval: pollInterval})
+	if err != nil {
+		log.Errorf("idle connection failed: %v", err)
+		// The main connection likely went with it, and either way the supervisor starts both afresh.
+		c.drop(err)
+	}
+}
+
+// Stop watching for updates, if we are.
+func (c *Client) unwatch() {
+	if c.stopWatching == nil {
+		return
+	}
+	close(c.stopWatching)
+	c.stopWatching = nil
+}
+
+// Translate the server's unilateral responses into our own updates.
+func (c *Client) translate(name string, conn *imapClient.Client, serverUpdates <-chan imapClient.Update, stop <-chan struct{}, count uint32) {
+	for {
+		var update jkmemail.Update
+		select {
+		case <-stop:
+			return
+		case <-conn.LoggedOut():
+			return
+		case u := <-serverUpdates:
+			switch u := u.(type) {
+			case *imapClient.MailboxUpdate:
+				// EXISTS and RECENT both land here; only a growing mailbox means new mail.
+				if u.Mailbox.Messages > count {
+					update = jkmemail.NewMessages{Mailbox: name, Count: int(u.Mailbox.Messages)}
+				}
+				count = u.Mailbox.Messages
+			case *imapClient.ExpungeUpdate:
+				if count > 0 {
+					count--
+				}
+				update = jkmemail.Expunged{Mailbox: name, SeqNum: u.SeqNum}
+			case *imapClient.MessageUpdate:
+				if _, ok := u.Message.Items[imap.FetchFlags]; ok {
+					update = jkmemail.FlagsChanged{
+						Mailbox: name,
+						SeqNum:  u.Message.SeqNum,
+						Flags:   fromIMAPFlags(u.Message.Flags),
+					}
+				}
+			}
+		}
+		if update == nil {
+			continue
+		}
+
+		log.Debugf("pushing update %#v", update)
+		select {
+		case c.updates <- update:
+		case <-stop:
+			return
+		}
+	}
+}
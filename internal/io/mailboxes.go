@@ -0,0 +1,161 @@
+package io
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// Listing and choosing mailboxes.
+
+// List every mailbox on the server, with message and unread counts for those which can hold messages.
+// INBOX comes first, and the rest are sorted by name so that children follow their parents.
+func (c *Client) Mailboxes() ([]jkmemail.Mailbox, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to list mailboxes: %v", err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		if !jkmemail.IsOffline(err) {
+			return nil, err
+		}
+		// The mailboxes as last listed, if any, are better than an error while offline.
+		log.Warnf("Listing mailboxes from the cache while offline: %v", err)
+		err = nil
+		cached := []jkmemail.Mailbox{}
+		if c.store != nil {
+			if cached, err = c.store.Mailboxes(); err != nil {
+				return nil, err
+			}
+		}
+		sortMailboxes(cached)
+		return cached, nil
+	}
+
+	mailboxes, err := c.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, mailbox := range mailboxes {
+		if !mailbox.Selectable() {
+			continue
+		}
+		// STATUS of the selected mailbox isn't to be relied on (RFC 3501 section 6.3.10), and we know its counts anyway.
+		if mailbox.Name == c.mailbox && c.uidNext != 0 {
+			mailboxes[i].Messages, mailboxes[i].Unread = c.selectedCounts()
+			continue
+		}
+		status, statusErr := c.in.Status(mailbox.Name, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+		if statusErr != nil {
+			// One unreadable mailbox shouldn't hide the rest.
+			log.Warnf("Failed to get status of mailbox %s: %v", mailbox.Name, statusErr)
+			continue
+		}
+		mailboxes[i].Messages = int(status.Messages)
+		mailboxes[i].Unread = int(status.Unseen)
+	}
+
+	sortMailboxes(mailboxes)
+	c.updateCache(func(s *store.Store) error {
+		return s.PutMailboxes(mailboxes)
+	})
+	return mailboxes, nil
+}
+
+// The message and unread counts of the selected mailbox, as of the last SELECT and the headers synced since.
+// Messages marked deleted count among the messages, as STATUS counts them, but not the unread.
+func (c *Client) selectedCounts() (messages, unread int) {
+	for _, header := range c.headers {
+		if !header.Flags.Has(jkmemail.Seen) {
+			unread++
+		}
+	}
+	return len(c.headers) + len(c.deleted), unread
+}
+
+// Sort mailboxes with INBOX first and the rest by name, so that children follow their parents.
+func sortMailboxes(mailboxes []jkmemail.Mailbox) {
+	sort.SliceStable(mailboxes, func(i, j int) bool {
+		if mailboxes[i].Name == jkmemail.Inbox || mailboxes[j].Name == jkmemail.Inbox {
+			return mailboxes[i].Name == jkmemail.Inbox
+		}
+		return mailboxes[i].Name < mailboxes[j].Name
+	})
+}
+
+// List the mailboxes on the server, without their counts.
+func (c *Client) listMailboxes() ([]jkmemail.Mailbox, error) {
+	infos := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.in.List("", "*", infos)
+	}()
+
+	mailboxes := []jkmemail.Mailbox{}
+	for info := range infos {
+		mailboxes = append(mailboxes, jkmemail.Mailbox{
+			Name:       info.Name,
+			Delimiter:  info.Delimiter,
+			Attributes: info.Attributes,
+		})
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return mailboxes, nil
+}
+
+// Switch to the named mailbox, fetching its messages and watching it for updates.
+func (c *Client) Select(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to select mailbox %s: %v", name, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		// A cached mailbox can still be read while offline.
+		if c.loadCache(name) {
+			log.Warnf("Selected %s from the cache while offline: %v", name, err)
+			err = nil
+		}
+		return err
+	}
+
+	// Keep what we had of the current mailbox, to go back to if the new one can't be fetched.
+	previous, previousValidity, previousNext, previousModSeq := c.mailbox, c.uidValidity, c.uidNext, c.highestModSeq
+	previousUIDs, previousHeaders, previousDeleted := c.uids, c.headers, c.deleted
+	c.mailbox = name
+	if !c.loadCache(name) {
+		c.resetCache(store.State{})
+	}
+	err = c.fetchMessages()
+	if err != nil {
+		c.mailbox, c.uidValidity, c.uidNext, c.highestModSeq = previous, previousValidity, previousNext, previousModSeq
+		c.uids, c.headers, c.deleted = previousUIDs, previousHeaders, previousDeleted
+		return err
+	}
+
+	c.watch(name)
+	return nil
+}
+
+// The name of the selected mailbox.
+func (c *Client) Selected() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mailbox
+}
@@ -0,0 +1,280 @@
+package io
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
+	"golang.org/x/net/html"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// MIME handling.
+//
+// Rather than fetch a whole message and parse it, we walk the BODYSTRUCTURE the server sends us,
+// fetch only the text parts we mean to show, and decode those.
+
+func init() {
+	// Decode every charset go-message knows in envelopes as well as bodies.
+	imap.CharsetReader = charset.Reader
+}
+
+// A text part of a message, located in its body structure.
+type textPart struct {
+	// The part's IMAP section path.
+	path []int
+
+	// The part's structure, which says how it is encoded.
+	structure *imap.BodyStructure
+}
+
+// The part's section path as text, e.g. "1.2".
+func (p textPart) id() string {
+	return partID(p.path)
+}
+
+// A section path as text, e.g. "1.2".
+func partID(path []int) string {
+	ids := make([]string, len(path))
+	for i, n := range path {
+		ids[i] = fmt.Sprint(n)
+	}
+	return strings.Join(ids, ".")
+}
+
+// The part's MIME type, e.g. "text/plain".
+func (p textPart) mimeType() string {
+	return strings.ToLower(p.structure.MIMEType + "/" + p.structure.MIMESubType)
+}
+
+// The section to fetch for the part, without marking the message as read.
+func (p textPart) section() *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Path: p.path},
+		Peek:         true,
+	}
+}
+
+// Find the inline text/plain and text/html parts of a message, in order.
+// Attachments and forwarded messages are left alone.
+func findTextParts(structure *imap.BodyStructure) []textPart {
+	parts := []textPart{}
+	if structure == nil {
+		return parts
+	}
+	structure.Walk(func(path []int, part *imap.BodyStructure) bool {
+		mimeType := strings.ToLower(part.MIMEType)
+		if mimeType == "message" {
+			return false
+		}
+		if mimeType != "text" || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+		subType := strings.ToLower(part.MIMESubType)
+		if subType == "plain" || subType == "html" {
+			parts = append(parts, textPart{path: path, structure: part})
+		}
+		return true
+	})
+	return parts
+}
+
+// Find a message's attachments: the parts which are files rather than text to read.
+// That means anything marked as an attachment or given a file name, and any non-text part.
+func findAttachments(structure *imap.BodyStructure) []jkmemail.Attachment {
+	attachments := []jkmemail.Attachment{}
+	if structure == nil {
+		return attachments
+	}
+	structure.Walk(func(path []int, part *imap.BodyStructure) bool {
+		mimeType := strings.ToLower(part.MIMEType)
+		if mimeType == "multipart" {
+			return true
+		}
+
+		filename, err := part.Filename()
+		if err != nil {
+			log.Warnf("Failed to decode attachment file name %q: %v", filename, err)
+		}
+		isAttached := strings.EqualFold(part.Disposition, "attachment") || filename != "" || mimeType != "text"
+		if !isAttached {
+			return true
+		}
+
+		id := partID(path)
+		if filename == "" && mimeType == "message" {
+			filename = fmt.Sprintf("message-%s.eml", id)
+		}
+		attachments = append(attachments, jkmemail.Attachment{
+			PartID:   id,
+			Filename: filename,
+			MIMEType: strings.ToLower(part.MIMEType + "/" + part.MIMESubType),
+			Size:     int(part.Size),
+		})
+		// Forwarded messages are saved whole, not picked apart.
+		return false
+	})
+	return attachments
+}
+
+// Parse a section path given as text, e.g. "1.2".
+func parsePartID(id string) ([]int, error) {
+	path := []int{}
+	for _, field := range strings.Split(id, ".") {
+		var n int
+		if _, err := fmt.Sscan(field, &n); err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid part id %q", id)
+		}
+		path = append(path, n)
+	}
+	return path, nil
+}
+
+// Decode the transfer encoding of an attachment's raw content.
+// Unlike text parts, the charset is left alone so the saved file is byte-for-byte what was sent.
+func decodeAttachment(encoding string, r io.Reader) ([]byte, error) {
+	header := message.Header{}
+	header.SetContentType("application/octet-stream", nil)
+	header.Set("Content-Transfer-Encoding", encoding)
+
+	entity, err := message.New(header, r)
+	if err != nil && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+	return io.ReadAll(entity.Body)
+}
+
+// Decode the transfer encoding and charset of a part's raw content.
+// Unknown encodings and charsets are shown undecoded rather than not at all.
+func decodePart(part textPart, r io.Reader) (string, error) {
+	header := message.Header{}
+	header.SetContentType(part.mimeType(), part.structure.Params)
+	header.Set("Content-Transfer-Encoding", part.structure.Encoding)
+
+	entity, err := message.New(header, r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return "", err
+	}
+	content, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// Pick the body to display from a message's decoded parts.
+// Plain text wins; HTML is converted to text only when there is no plain text.
+func displayBody(parts []jkmemail.Part) string {
+	plain, rich := []string{}, []string{}
+	for _, part := range parts {
+		switch part.MIMEType {
+		case "text/plain":
+			plain = append(plain, part.Content)
+		case "text/html":
+			rich = append(rich, htmlToText(part.Content))
+		}
+	}
+	if len(plain) > 0 {
+		return strings.Join(plain, "\n\n")
+	}
+	return strings.Join(rich, "\n\n")
+}
+
+// Runs of blank lines left behind by block elements.
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// Convert HTML to readable plain text.
+// Block elements become line breaks, links keep their targets and scripts and styles are dropped.
+func htmlToText(source string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	text := new(strings.Builder)
+	skipping := 0
+	var href string
+
+	// The last byte written, to avoid doubling up spaces.
+	var last byte
+	// Whether the previous text ended in whitespace, which separates it from the next.
+	spaced := false
+	write := func(s string) {
+		if s == "" {
+			return
+		}
+		text.WriteString(s)
+		last = s[len(s)-1]
+	}
+
+	for {
+		token := tokenizer.Next()
+		switch token {
+		case html.ErrorToken:
+			result := blankLines.ReplaceAllString(text.String(), "\n\n")
+			return strings.TrimSpace(result)
+
+		case html.TextToken:
+			if skipping > 0 {
+				continue
+			}
+			// Collapse the source's whitespace the way a browser would.
+			raw := html.UnescapeString(string(tokenizer.Text()))
+			words := strings.Fields(raw)
+			if len(words) == 0 {
+				spaced = spaced || raw != ""
+				continue
+			}
+			if (spaced || unicode.IsSpace(rune(raw[0]))) && last != 0 && last != '\n' && last != ' ' {
+				write(" ")
+			}
+			write(strings.Join(words, " "))
+			spaced = unicode.IsSpace(rune(raw[len(raw)-1]))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttributes := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				if token == html.StartTagToken {
+					skipping++
+				}
+			case "br":
+				write("\n")
+			case "p", "div", "table", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "ul", "ol":
+				write("\n\n")
+			case "li":
+				write("\n- ")
+			case "td", "th":
+				write(" ")
+			case "a":
+				href = ""
+				for hasAttributes {
+					var key, value []byte
+					key, value, hasAttributes = tokenizer.TagAttr()
+					if string(key) == "href" {
+						href = string(value)
+					}
+				}
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head", "title":
+				if skipping > 0 {
+					skipping--
+				}
+			case "p", "div", "table", "tr", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "ul", "ol":
+				write("\n\n")
+			case "a":
+				if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(href, "mailto:") {
+					write(fmt.Sprintf(" <%s>", href))
+				}
+				href = ""
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package io
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// Deleting, archiving and moving messages.
+
+// The names servers commonly give mailboxes when they don't advertise SPECIAL-USE attributes.
+var specialUseNames = map[string][]string{
+	`\Trash`:   {"Trash", "Deleted Items", "Deleted Messages", "[Gmail]/Trash"},
+	`\Archive`: {"Archive", "Archives", "[Gmail]/All Mail"},
+	`\Sent`:    {"Sent", "Sent Items", "Sent Messages", "[Gmail]/Sent Mail"},
+	`\Drafts`:  {"Drafts", "[Gmail]/Drafts"},
+}
+
+// An EXPUNGE of just the given UIDs, which needs the UIDPLUS extension.
+// See RFC 4315 section 2.1.
+type uidExpunge struct {
+	seqSet *imap.SeqSet
+}
+
+func (cmd *uidExpunge) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{cmd.seqSet},
+	}
+}
+
+// Find the mailbox with the given special use, e.g. \Trash.
+// Servers which don't advertise special uses are matched by the usual names for them.
+// The empty string means the server has no such mailbox.
+func (c *Client) specialUse(attribute string) (string, error) {
+	mailboxes, err := c.listMailboxes()
+	if err != nil {
+		return "", err
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.Has(attribute) {
+			return mailbox.Name, nil
+		}
+	}
+	for _, name := range specialUseNames[attribute] {
+		for _, mailbox := range mailboxes {
+			if strings.EqualFold(mailbox.Name, name) && mailbox.Selectable() {
+				return mailbox.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Find the mailbox for a special use: the configured one if there is one, or else the server's,
+// and failing both, the fallback, which is made if need be.
+func (c *Client) specialMailbox(configured, attribute, fallback string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	name, err := c.specialUse(attribute)
+	if err != nil || name != "" {
+		return name, err
+	}
+	log.Infof("Creating mailbox %s for %s", fallback, attribute)
+	if err := c.in.Create(fallback); err != nil {
+		return "", fmt.Errorf("creating %s mailbox: %w", fallback, err)
+	}
+	return fallback, nil
+}
+
+// Forget a message which has left the selected mailbox.
+func (c *Client) forget(uid uint32) {
+	delete(c.headers, uid)
+	c.updateCache(func(s *store.Store) error {
+		return s.Remove(c.mailbox, c.uidValidity, int(uid))
+	})
+	for i, u := range c.uids {
+		if u == uid {
+			c.uids = append(c.uids[:i], c.uids[i+1:]...)
+			break
+		}
+	}
+}
+
+// Expunge the given messages, which are marked \Deleted, and nothing else, reporting whether they were expunged.
+// Without UIDPLUS, EXPUNGE takes every message marked \Deleted in the mailbox, so it's only sent when
+// the given messages are the only ones marked. Otherwise they're left marked, as the others may not be ours to purge.
+func (c *Client) expunge(seqSet *imap.SeqSet) (bool, error) {
+	ok, err := c.in.Support("UIDPLUS")
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		status, err := c.in.Execute(&commands.Uid{Cmd: &uidExpunge{seqSet: seqSet}}, nil)
+		if err != nil {
+			return false, err
+		}
+		return true, status.Err()
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.DeletedFlag}
+	deleted, err := c.in.UidSearch(criteria)
+	if err != nil {
+		return false, err
+	}
+	for _, uid := range deleted {
+		if !seqSet.Contains(uid) {
+			log.Warnf("Leaving %s marked deleted rather than expunging, as other messages are marked deleted too", seqSet)
+			return false, nil
+		}
+	}
+	log.Infof("Expunging %s, the only messages marked deleted", seqSet)
+	return true, c.in.Expunge(nil)
+}
+
+// Move a message to another mailbox.
+// This uses MOVE where the server has it, and COPY, STORE and EXPUNGE where it doesn't.
+func (c *Client) Move(id int, mailbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to move email with id %d to %s: '%v'", id, mailbox, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+	if mailbox == c.mailbox {
+		return nil
+	}
+
+	uid := uint32(id)
+	err = c.move(uid, mailbox)
+	if err != nil {
+		return err
+	}
+	c.forget(uid)
+	return nil
+}
+
+// Move a message without the bookkeeping.
+func (c *Client) move(uid uint32, mailbox string) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+
+	ok, err := c.in.Support("MOVE")
+	if err != nil {
+		return err
+	}
+	if ok {
+		return c.in.UidMove(seqSet, mailbox)
+	}
+
+	if err := c.in.UidCopy(seqSet, mailbox); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.in.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+	expunged, err := c.expunge(seqSet)
+	if err == nil && !expunged {
+		c.deleted[uid] = true
+	}
+	return err
+}
+
+// Delete a message.
+// It goes to the trash if the server has one, and is expunged if it doesn't or it is already in the trash.
+func (c *Client) Delete(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to delete email with id %d: '%v'", id, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	trash, err := c.specialUse(`\Trash`)
+	if err != nil {
+		return err
+	}
+
+	uid := uint32(id)
+	if trash != "" && trash != c.mailbox {
+		err = c.move(uid, trash)
+	} else {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(uid)
+		item := imap.FormatFlagsOp(imap.AddFlags, true)
+		err = c.in.UidStore(seqSet, item, []interface{}{imap.DeletedFlag}, nil)
+		if err == nil {
+			var expunged bool
+			expunged, err = c.expunge(seqSet)
+			if err == nil && !expunged {
+				c.deleted[uid] = true
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.forget(uid)
+	return nil
+}
+
+// Archive a message, by moving it to the configured archive mailbox.
+// Without one configured, the server's \Archive mailbox is used, and failing that an "Archive" mailbox is made.
+func (c *Client) Archive(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to archive email with id %d: '%v'", id, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	archive, err := c.specialMailbox(c.cfg.ArchiveMailbox, `\Archive`, "Archive")
+	if err != nil {
+		return err
+	}
+	if archive == c.mailbox {
+		return nil
+	}
+
+	uid := uint32(id)
+	err = c.move(uid, archive)
+	if err != nil {
+		return err
+	}
+	c.forget(uid)
+	return nil
+}
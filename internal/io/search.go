@@ -0,0 +1,101 @@
+package io
+
+import (
+	"sort"
+
+	"github.com/emersion/go-imap"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Searching the selected mailbox on the server.
+
+// The IMAP search criteria for a query.
+// IMAP can't search for attachments, so that part of a query is left for `Search` to check.
+func searchCriteria(query jkmemail.Query) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.DeletedFlag}
+	for _, value := range query.From {
+		criteria.Header.Add("From", value)
+	}
+	for _, value := range query.To {
+		criteria.Header.Add("To", value)
+	}
+	for _, value := range query.Cc {
+		criteria.Header.Add("Cc", value)
+	}
+	for _, value := range query.Subject {
+		criteria.Header.Add("Subject", value)
+	}
+	criteria.Body = query.Body
+	criteria.Text = query.Text
+	criteria.Since = query.Since
+	criteria.Before = query.Before
+	for flag, imapFlag := range imapFlags {
+		if query.WithFlags.Has(flag) {
+			criteria.WithFlags = append(criteria.WithFlags, imapFlag)
+		}
+		if query.WithoutFlags.Has(flag) {
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imapFlag)
+		}
+	}
+	return criteria
+}
+
+// Search the selected mailbox with UID SEARCH, returning the headers of the matches newest first.
+// The results are kept apart from the cached listing of the mailbox.
+func (c *Client) Search(query jkmemail.Query) ([]jkmemail.MessageHeader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to search %s: %v", c.mailbox, err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		return nil, err
+	}
+
+	uids, err := c.in.UidSearch(searchCriteria(query))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("search of %s found %d messages", c.mailbox, len(uids))
+	headers := []jkmemail.MessageHeader{}
+	if len(uids) == 0 {
+		return headers, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags, referencesSection.FetchItem()}
+	if query.HasAttachment {
+		items = append(items, imap.FetchBodyStructure)
+	}
+
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.in.UidFetch(seqSet, items, messages)
+	}()
+	for msg := range messages {
+		if msg.Envelope == nil {
+			continue
+		}
+		if query.HasAttachment && len(findAttachments(msg.BodyStructure)) == 0 {
+			continue
+		}
+		headers = append(headers, messageHeader(msg))
+	}
+	if err = <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].ID > headers[j].ID
+	})
+	return headers, nil
+}
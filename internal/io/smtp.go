@@ -0,0 +1,139 @@
+package io
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Delivering messages over SMTP, and keeping a copy of what was sent.
+//
+// We speak SMTP ourselves rather than leaving it to the email package, which renders the message afresh
+// each time it's asked: with a new Message-ID and MIME boundaries, the copy saved to the sent mailbox
+// wouldn't be what the recipients got.
+
+// Deliver a rendered message to the given recipients, over a connection secured as configured.
+func (c *Client) deliver(server string, port int, auth smtp.Auth, from string, recipients []string, raw []byte) error {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("parsing sender %q: %w", from, err)
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	to := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		addr, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return fmt.Errorf("parsing recipient %q: %w", recipient, err)
+		}
+		to[i] = addr.Address
+	}
+
+	conn, err := c.dialSMTP(server, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if auth != nil {
+		if ok, _ := conn.Extension("AUTH"); ok {
+			if err := conn.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := conn.Mail(sender.Address); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := conn.Rcpt(addr); err != nil {
+			return fmt.Errorf("recipient %s: %w", addr, err)
+		}
+	}
+	w, err := conn.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return conn.Quit()
+}
+
+// Dial the SMTP server, secured as configured.
+// There's no falling back to something less secure than configured.
+func (c *Client) dialSMTP(server string, port int) (*smtp.Client, error) {
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	security := c.cfg.SMTPConnectionSecurity()
+	if security == configure.NoSecurity {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return smtp.NewClient(conn, server)
+	}
+
+	tlsConfig, err := c.tlsConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	if security == configure.ImplicitTLS {
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return smtp.NewClient(conn, server)
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Carrying on in plaintext when STARTTLS was asked for would give the password away.
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		client.Close()
+		return nil, fmt.Errorf("%s doesn't offer STARTTLS", server)
+	}
+	if err := client.StartTLS(tlsConfig); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Save a copy of a message we sent to the sent mailbox, marked as read.
+func (c *Client) saveSent(raw []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.ensureConnected()
+	if err != nil {
+		return err
+	}
+
+	sent, err := c.specialMailbox(c.cfg.SentMailbox, `\Sent`, "Sent")
+	if err != nil {
+		return err
+	}
+	log.Infof("saving sent message to %s", sent)
+	return c.in.Append(sent, []string{imap.SeenFlag}, time.Now(), bytes.NewBuffer(raw))
+}
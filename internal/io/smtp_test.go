@@ -0,0 +1,156 @@
+package io
+
+import (
+	"bytes"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+
+	"github.com/jcc333/jkm/internal/configure"
+	jkmemail "github.com/jcc333/jkm/internal/email"
+)
+
+// A message the stand-in SMTP server was given: who it was for, and what it was.
+type delivery struct {
+	recipients []string
+	data       []byte
+}
+
+// A stand-in SMTP server which takes one message, and hands over what it was sent.
+func newTestSMTPServer(t *testing.T) (port int, received <-chan delivery) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan delivery, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ready")
+		var recipients []string
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+			case "EHLO", "HELO", "MAIL":
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				recipients = append(recipients, strings.Trim(strings.TrimPrefix(strings.ToUpper(line), "RCPT TO:"), "<> "))
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				messages <- delivery{recipients: recipients, data: data}
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, messages
+}
+
+func TestSendSavesWhatWasSent(t *testing.T) {
+	cfg, be := newTestServer(t)
+	port, received := newTestSMTPServer(t)
+	cfg.SMTPServer = "127.0.0.1"
+	cfg.SMTPPort = port
+	cfg.SMTPSecurity = configure.NoSecurity
+	cfg.SaveSent = true
+	c := connectTestClient(t, cfg)
+
+	err := c.Send(jkmemail.Message{
+		MessageHeader: jkmemail.MessageHeader{To: []jkmemail.Address{{Address: "bob@example.com"}}, Subject: "hello"},
+		Body:          "hi bob",
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	sent := (<-received).data
+
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := user.GetMailbox("Sent")
+	if err != nil {
+		t.Fatalf("no Sent mailbox: %v", err)
+	}
+	saved := mailbox.(*memory.Mailbox).Messages
+	if len(saved) != 1 {
+		t.Fatalf("%d messages saved to Sent, want 1", len(saved))
+	}
+	// The stand-in reads lines as text, without their CRLFs or the final line break SMTP adds.
+	if !bytes.Equal(normalizeLines(saved[0].Body), normalizeLines(sent)) {
+		t.Errorf("saved copy differs from what was sent:\n%s\n---\n%s", saved[0].Body, sent)
+	}
+	if !hasIMAPFlag(saved[0].Flags, imap.SeenFlag) {
+		t.Errorf("saved copy has flags %v, want \\Seen", saved[0].Flags)
+	}
+}
+
+func TestSendBlindCopies(t *testing.T) {
+	cfg, be := newTestServer(t)
+	port, received := newTestSMTPServer(t)
+	cfg.SMTPServer = "127.0.0.1"
+	cfg.SMTPPort = port
+	cfg.SMTPSecurity = configure.NoSecurity
+	cfg.SaveSent = true
+	c := connectTestClient(t, cfg)
+
+	err := c.Send(jkmemail.Message{
+		MessageHeader: jkmemail.MessageHeader{
+			To:      []jkmemail.Address{{Address: "bob@example.com"}},
+			Cc:      []jkmemail.Address{{Name: "Carol C", Address: "carol@example.com"}},
+			Subject: "hello",
+		},
+		Body: "hi all",
+		Bcc:  []jkmemail.Address{{Address: "dave@example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	sent := <-received
+
+	if want := []string{"BOB@EXAMPLE.COM", "CAROL@EXAMPLE.COM", "DAVE@EXAMPLE.COM"}; strings.Join(sent.recipients, " ") != strings.Join(want, " ") {
+		t.Errorf("sent to %v, want %v", sent.recipients, want)
+	}
+	if !bytes.Contains(sent.data, []byte("Cc: \"Carol C\" <carol@example.com>")) {
+		t.Errorf("sent without the Cc header:\n%s", sent.data)
+	}
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := user.GetMailbox("Sent")
+	if err != nil {
+		t.Fatalf("no Sent mailbox: %v", err)
+	}
+	saved := mailbox.(*memory.Mailbox).Messages
+	for _, raw := range [][]byte{sent.data, saved[0].Body} {
+		if bytes.Contains(bytes.ToLower(raw), []byte("dave")) {
+			t.Errorf("blind copy shows in the message:\n%s", raw)
+		}
+	}
+}
+
+func normalizeLines(b []byte) []byte {
+	return bytes.TrimRight(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n")), "\n")
+}
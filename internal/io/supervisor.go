@@ -0,0 +1,196 @@
+package io
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	imapClient "github.com/emersion/go-imap/client"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Keeping the connection to the server up.
+//
+// Each connection gets a supervisor, which waits for it to drop: the connection logging out,
+// a command on it failing with a network error, or the idle connection beside it failing.
+// It then reconnects with exponential backoff and jitter, which re-selects the mailbox we were in,
+// and publishes how the connection stands as updates along the way.
+// While we're reconnecting, commands fail fast rather than dialling, and the list is served from the cache.
+
+const (
+	// How long to wait for the server to answer when dialling.
+	dialTimeout = 30 * time.Second
+
+	// How long the user has to authorize us with OAuth2.
+	authorizeTimeout = 10 * time.Minute
+
+	// The delay before the first attempt to reconnect, doubling with each failure up to maxBackoff.
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+
+	// After this many failed attempts, we're offline rather than reconnecting.
+	offlineAfter = 3
+)
+
+// Returned by commands while the supervisor is reconnecting.
+var errReconnecting = fmt.Errorf("%w, reconnecting", jkmemail.ErrOffline)
+
+// The delay before the given attempt to reconnect, counting from zero.
+// The jitter spreads out clients which all lost their connections at once, say to a server restart.
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 16 && minBackoff<<attempt < maxBackoff {
+		delay = minBackoff << attempt
+	}
+	// Somewhere between half and all of the delay.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Whether an error means the connection itself is broken, rather than the server refusing a command.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, imapClient.ErrNotLoggedIn) || errors.Is(err, imapClient.ErrAlreadyLoggedOut)
+}
+
+// Report that the connection is broken, for its supervisor to reconnect.
+// A report already waiting is enough.
+func (c *Client) drop(err error) {
+	select {
+	case c.dropped <- err:
+	default:
+	}
+}
+
+// Start supervising a fresh connection, in place of any before it.
+func (c *Client) supervise(conn *imapClient.Client) {
+	c.unsupervise()
+	stop := make(chan struct{})
+	c.stopSupervising = stop
+	// Reports about the old connection don't count against this one.
+	select {
+	case <-c.dropped:
+	default:
+	}
+	go c.superviseUntil(conn, stop)
+}
+
+// Stop supervising the connection, if we are.
+func (c *Client) unsupervise() {
+	if c.stopSupervising == nil {
+		return
+	}
+	close(c.stopSupervising)
+	c.stopSupervising = nil
+}
+
+// Wait for the connection to drop, then reconnect.
+func (c *Client) superviseUntil(conn *imapClient.Client, stop <-chan struct{}) {
+	var err error
+	select {
+	case <-stop:
+		return
+	case <-conn.LoggedOut():
+		err = fmt.Errorf("connection closed")
+	case err = <-c.dropped:
+	}
+	log.Warnf("Lost connection to IMAP server: %v", err)
+
+	c.mu.Lock()
+	select {
+	case <-stop:
+		// We were disconnected on purpose.
+		c.mu.Unlock()
+		return
+	default:
+	}
+	c.isReconnecting = true
+	if c.in == conn {
+		c.in = nil
+	}
+	c.unwatch()
+	c.mu.Unlock()
+	conn.Terminate()
+	c.reconnect(err, stop)
+}
+
+// Try to reconnect with backoff until we're back or told to stop, having lost the connection to err.
+// Failing any other way than to reach the server stops us trying, as it won't mend by itself:
+// a certificate which can't be trusted is for the user to decide about, and a refused login
+// tried again and again could get the account locked. Either is published, and we stay offline.
+func (c *Client) reconnect(err error, stop <-chan struct{}) {
+	for attempt := 0; ; attempt++ {
+		var certErr *jkmemail.CertificateError
+		if errors.As(err, &certErr) {
+			c.giveUp(err)
+			return
+		}
+
+		state := jkmemail.Reconnecting
+		if attempt >= offlineAfter {
+			state = jkmemail.Offline
+		}
+		delay := backoff(attempt)
+		c.publish(jkmemail.ConnectionChanged{State: state, Retry: time.Now().Add(delay), Err: err})
+		log.Infof("reconnecting to IMAP server in %v", delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		// Dialling is left out of turn, so that commands fail fast while it takes its time.
+		var conn *imapClient.Client
+		conn, err = c.dial()
+		if err != nil {
+			log.Errorf("Failed to connect to IMAP server: %v", err)
+			if !isConnectionError(err) {
+				c.giveUp(err)
+				return
+			}
+			continue
+		}
+		c.mu.Lock()
+		select {
+		case <-stop:
+			c.mu.Unlock()
+			conn.Logout()
+			return
+		default:
+		}
+		err = c.setUp(conn)
+		if err == nil {
+			c.isReconnecting = false
+		}
+		c.mu.Unlock()
+		if err == nil {
+			log.Infof("reconnected to IMAP server after %d attempts", attempt+1)
+			c.publish(jkmemail.ConnectionChanged{State: jkmemail.Connected})
+			return
+		}
+		if !isConnectionError(err) {
+			c.giveUp(err)
+			return
+		}
+	}
+}
+
+// Stop trying to reconnect, for a reason which won't mend by itself, and publish it.
+// Commands go on failing fast, rather than each trying the server again.
+func (c *Client) giveUp(err error) {
+	log.Errorf("Not reconnecting to IMAP server: %v", err)
+	c.publish(jkmemail.ConnectionChanged{State: jkmemail.Offline, Err: err})
+}
+
+// Publish an update of our own alongside those the server pushes.
+func (c *Client) publish(update jkmemail.Update) {
+	select {
+	case c.updates <- update:
+	default:
+		log.Warnf("Dropped update %#v, as nobody is taking them", update)
+	}
+}
@@ -0,0 +1,448 @@
+package io
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+	"github.com/jcc333/jkm/internal/store"
+)
+
+// Keeping the selected mailbox's headers in step with the server.
+//
+// The first sync of a mailbox fetches every message's envelope. After that, only what changed is fetched:
+// the envelopes of messages from the last UIDNEXT on, the flags of messages changed since the last HIGHESTMODSEQ
+// where the server has CONDSTORE (RFC 7162), and the UIDs of the messages which vanished where it has QRESYNC.
+// Without CONDSTORE, every message's flags are fetched instead. go-imap knows none of these extensions,
+// so we speak them ourselves. If a mailbox's UIDVALIDITY changes, the UIDs we knew no longer mean anything,
+// and it's synced from scratch.
+
+// The fetch item for a message's modification sequence.
+const fetchModSeq imap.FetchItem = "MODSEQ"
+
+// An ENABLE command, to turn on an extension for the rest of the connection. See RFC 5161.
+type enableCommand struct {
+	capability string
+}
+
+func (cmd *enableCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "ENABLE",
+		Arguments: []interface{}{imap.RawString(cmd.capability)},
+	}
+}
+
+// A FETCH of the flags of the messages changed since a modification sequence, to be wrapped in commands.Uid.
+// With vanished, the server also says which of the messages have been expunged since.
+type changedSinceCommand struct {
+	seqSet   *imap.SeqSet
+	modSeq   uint64
+	vanished bool
+}
+
+func (cmd *changedSinceCommand) Command() *imap.Command {
+	modifiers := []interface{}{imap.RawString("CHANGEDSINCE"), imap.RawString(strconv.FormatUint(cmd.modSeq, 10))}
+	if cmd.vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	return &imap.Command{
+		Name: "FETCH",
+		Arguments: []interface{}{
+			cmd.seqSet,
+			[]interface{}{imap.RawString(imap.FetchUid), imap.RawString(imap.FetchFlags), imap.RawString(fetchModSeq)},
+			modifiers,
+		},
+	}
+}
+
+// Collects the messages and vanished UIDs from a CHANGEDSINCE fetch.
+type changedSinceResponse struct {
+	messages []*imap.Message
+	vanished imap.SeqSet
+}
+
+func (r *changedSinceResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+	switch name {
+	case "FETCH":
+		// * 12 FETCH (UID 34 FLAGS (\Seen) MODSEQ (5678))
+		if len(fields) < 2 {
+			return fmt.Errorf("FETCH response has too few fields: %v", fields)
+		}
+		items, ok := fields[1].([]interface{})
+		if !ok {
+			return fmt.Errorf("FETCH response items are not a list: %v", fields[1])
+		}
+		msg := &imap.Message{}
+		if err := msg.Parse(items); err != nil {
+			return err
+		}
+		r.messages = append(r.messages, msg)
+	case "VANISHED":
+		// * VANISHED (EARLIER) 41,43:116
+		if len(fields) < 1 {
+			return fmt.Errorf("VANISHED response has no UIDs")
+		}
+		uids, err := imap.ParseString(fields[len(fields)-1])
+		if err != nil {
+			return err
+		}
+		if err := r.vanished.Add(uids); err != nil {
+			return err
+		}
+	default:
+		return responses.ErrUnhandled
+	}
+	return nil
+}
+
+// A message's modification sequence, or zero if it wasn't fetched.
+func modSeq(msg *imap.Message) uint64 {
+	fields, _ := msg.Items[fetchModSeq].([]interface{})
+	if len(fields) == 0 {
+		return 0
+	}
+	s, err := imap.ParseString(fields[0])
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+// Turn on QRESYNC if the server has it, reporting whether it's on.
+func (c *Client) enableQResync() bool {
+	ok, err := c.in.Support("QRESYNC")
+	if err != nil || !ok {
+		return false
+	}
+	status, err := c.in.Execute(&enableCommand{capability: "QRESYNC"}, nil)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		log.Warnf("Failed to enable QRESYNC: %v", err)
+		return false
+	}
+	return true
+}
+
+// The changes found by a sync, to apply to the cache.
+type mailboxChanges struct {
+	// Headers which are new or whose flags changed.
+	changed []jkmemail.MessageHeader
+
+	// Messages which have left the mailbox, or been marked deleted.
+	gone []int
+
+	// Messages we have no header for yet.
+	unknown imap.SeqSet
+}
+
+// Note the flags of a fetched message, which may be one we haven't seen yet.
+func (c *Client) noteFlags(changes *mailboxChanges, msg *imap.Message) {
+	header, ok := c.headers[msg.Uid]
+	switch {
+	case hasIMAPFlag(msg.Flags, imap.DeletedFlag):
+		// Deleted messages are as good as gone, and are left out of the list.
+		c.deleted[msg.Uid] = true
+		if ok {
+			changes.gone = append(changes.gone, int(msg.Uid))
+		}
+	case !ok:
+		// New, or no longer deleted.
+		delete(c.deleted, msg.Uid)
+		changes.unknown.AddNum(msg.Uid)
+	case fromIMAPFlags(msg.Flags) != header.Flags:
+		header.Flags = fromIMAPFlags(msg.Flags)
+		c.headers[msg.Uid] = header
+		changes.changed = append(changes.changed, header)
+	}
+}
+
+// Whether the flags include the given flag.
+func hasIMAPFlag(flags []string, name string) bool {
+	for _, flag := range flags {
+		if imap.CanonicalFlag(flag) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh the cached contents of the selected mailbox, fetching only what changed since it was last synced.
+func (c *Client) fetchMessages() error {
+	if c.in == nil {
+		return fmt.Errorf("Fetching before connected to IMAP server")
+	}
+	mailbox, err := c.in.Select(c.mailbox, false)
+	if err != nil {
+		log.Errorf("Failed to select %s: %v", c.mailbox, err)
+		return err
+	}
+	return c.syncMessages(mailbox)
+}
+
+// Refresh the cached contents of the mailbox, as it stands having just been selected.
+func (c *Client) syncMessages(mailbox *imap.MailboxStatus) error {
+	var err error
+	defer func() {
+		c.lastRefreshed = time.Now()
+		if err != nil {
+			log.Errorf("Failed to fetch messages: %v", err)
+		}
+	}()
+
+	if mailbox.UidValidity != c.uidValidity {
+		log.Infof("UIDVALIDITY of %s changed from %d to %d, syncing it from scratch", c.mailbox, c.uidValidity, mailbox.UidValidity)
+		c.resetCache(store.State{UIDValidity: mailbox.UidValidity})
+	}
+	condstore, err := c.in.Support("CONDSTORE")
+	if err != nil {
+		return err
+	}
+	condstore = condstore || c.qresync
+
+	changes := &mailboxChanges{}
+	highestModSeq := c.highestModSeq
+	isFullSync := c.uidNext == 0 || len(c.headers) == 0
+	// The messages from here on are new, and the rest we knew of before.
+	lastKnown := c.uidNext - 1
+	if isFullSync || mailbox.Messages == 0 {
+		c.deleted = make(map[uint32]bool)
+	}
+	switch {
+	case mailbox.Messages == 0:
+		for uid := range c.headers {
+			changes.gone = append(changes.gone, int(uid))
+		}
+	case isFullSync:
+		changes.unknown.AddRange(1, 0)
+	case condstore && c.highestModSeq > 0:
+		if mailbox.UidNext > c.uidNext {
+			changes.unknown.AddRange(c.uidNext, 0)
+		}
+		err = c.syncChangedSince(changes, &highestModSeq)
+		if err != nil {
+			return err
+		}
+	default:
+		if mailbox.UidNext > c.uidNext {
+			changes.unknown.AddRange(c.uidNext, 0)
+		}
+		err = c.syncAllFlags(changes, condstore, &highestModSeq)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !changes.unknown.Empty() {
+		// References are fetched for threading mailboxes ourselves.
+		items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchFlags, referencesSection.FetchItem()}
+		if condstore && isFullSync {
+			items = append(items, fetchModSeq)
+		}
+		isFetched := make(map[uint32]bool)
+		err = c.fetchEach(&changes.unknown, items, func(msg *imap.Message) {
+			if hasIMAPFlag(msg.Flags, imap.DeletedFlag) {
+				c.deleted[msg.Uid] = true
+				return
+			}
+			if msg.Envelope == nil {
+				return
+			}
+			isFetched[msg.Uid] = true
+			// A range like 120:* always includes the last message, even when it's older than 120.
+			if _, ok := c.headers[msg.Uid]; ok && !isFullSync {
+				return
+			}
+			header := messageHeader(msg)
+			c.headers[msg.Uid] = header
+			changes.changed = append(changes.changed, header)
+			if isFullSync && modSeq(msg) > highestModSeq {
+				highestModSeq = modSeq(msg)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if isFullSync {
+			// Anything cached which didn't turn up is long gone.
+			for uid := range c.headers {
+				if !isFetched[uid] {
+					changes.gone = append(changes.gone, int(uid))
+				}
+			}
+		}
+	}
+
+	c.removeGone(changes)
+	// Without QRESYNC, a count that doesn't add up means messages vanished, and only a search says which.
+	// The server counts the messages marked \Deleted until they're expunged, so we count them too.
+	if !isFullSync && !c.qresync && int(mailbox.Messages) != len(c.headers)+len(c.deleted) {
+		log.Infof("%s has %d messages where we know of %d, searching for those which vanished", c.mailbox, mailbox.Messages, len(c.headers)+len(c.deleted))
+		err = c.syncVanished(changes, lastKnown)
+		if err != nil {
+			return err
+		}
+		c.removeGone(changes)
+	}
+
+	c.uids = make([]uint32, 0, len(c.headers))
+	for uid := range c.headers {
+		c.uids = append(c.uids, uid)
+	}
+	sort.Slice(c.uids, func(i, j int) bool { return c.uids[i] > c.uids[j] })
+	c.uidNext = mailbox.UidNext
+	if condstore {
+		c.highestModSeq = highestModSeq
+	}
+	log.Infof("synced %s: %d messages, %d changed, %d gone", c.mailbox, len(c.uids), len(changes.changed), len(changes.gone))
+
+	// The state goes last, so that a sync which fails part way is done again.
+	c.updateCache(func(s *store.Store) error {
+		if err := s.PutHeaders(c.mailbox, c.uidValidity, changes.changed); err != nil {
+			return err
+		}
+		if err := s.Remove(c.mailbox, c.uidValidity, changes.gone...); err != nil {
+			return err
+		}
+		return s.SetState(c.mailbox, store.State{UIDValidity: c.uidValidity, UIDNext: c.uidNext, HighestModSeq: c.highestModSeq})
+	})
+	return nil
+}
+
+// Find the messages whose flags changed since the last sync, and with QRESYNC, those which vanished.
+// New messages are changed too, so the highest modification sequence seen here is safe to sync on from next time.
+func (c *Client) syncChangedSince(changes *mailboxChanges, highestModSeq *uint64) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+	response := &changedSinceResponse{}
+	cmd := &changedSinceCommand{seqSet: seqSet, modSeq: c.highestModSeq, vanished: c.qresync}
+	status, err := c.in.Execute(&commands.Uid{Cmd: cmd}, response)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range response.messages {
+		c.noteFlags(changes, msg)
+		if modSeq(msg) > *highestModSeq {
+			*highestModSeq = modSeq(msg)
+		}
+	}
+	for uid := range c.headers {
+		if response.vanished.Contains(uid) {
+			changes.gone = append(changes.gone, int(uid))
+		}
+	}
+	for uid := range c.deleted {
+		if response.vanished.Contains(uid) {
+			delete(c.deleted, uid)
+		}
+	}
+	return nil
+}
+
+// Fetch every message's flags to find those which changed, and those which vanished.
+// With CONDSTORE, their modification sequences are fetched too, to sync on from next time.
+func (c *Client) syncAllFlags(changes *mailboxChanges, condstore bool, highestModSeq *uint64) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+	if condstore {
+		items = append(items, fetchModSeq)
+	}
+	isListed := make(map[uint32]bool, len(c.headers))
+	err := c.fetchEach(seqSet, items, func(msg *imap.Message) {
+		isListed[msg.Uid] = true
+		c.noteFlags(changes, msg)
+		if modSeq(msg) > *highestModSeq {
+			*highestModSeq = modSeq(msg)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for uid := range c.headers {
+		if !isListed[uid] {
+			changes.gone = append(changes.gone, int(uid))
+		}
+	}
+	for uid := range c.deleted {
+		if !isListed[uid] {
+			delete(c.deleted, uid)
+		}
+	}
+	return nil
+}
+
+// Search for the messages we knew of before this sync which are still in the mailbox, deleted or not,
+// to find those which vanished. Those we have no header for are the ones marked \Deleted.
+func (c *Client) syncVanished(changes *mailboxChanges, lastKnown uint32) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, lastKnown)
+	uids, err := c.in.UidSearch(&imap.SearchCriteria{Uid: seqSet})
+	if err != nil {
+		return err
+	}
+	isListed := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		isListed[uid] = true
+	}
+	for uid := range c.headers {
+		if uid <= lastKnown && !isListed[uid] {
+			changes.gone = append(changes.gone, int(uid))
+		}
+	}
+	for uid := range c.deleted {
+		if uid <= lastKnown {
+			delete(c.deleted, uid)
+		}
+	}
+	for uid := range isListed {
+		if _, ok := c.headers[uid]; !ok {
+			c.deleted[uid] = true
+		}
+	}
+	return nil
+}
+
+// Forget the headers of the messages which are gone, noting each of them once.
+func (c *Client) removeGone(changes *mailboxChanges) {
+	isGone := make(map[int]bool, len(changes.gone))
+	gone := changes.gone[:0]
+	for _, id := range changes.gone {
+		if !isGone[id] {
+			isGone[id] = true
+			gone = append(gone, id)
+		}
+		delete(c.headers, uint32(id))
+	}
+	changes.gone = gone
+}
+
+// Fetch items of a set of messages by UID, handling each as it arrives.
+func (c *Client) fetchEach(seqSet *imap.SeqSet, items []imap.FetchItem, handle func(msg *imap.Message)) error {
+	messages := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.in.UidFetch(seqSet, items, messages)
+	}()
+	for msg := range messages {
+		handle(msg)
+	}
+	return <-done
+}
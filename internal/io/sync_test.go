@@ -0,0 +1,102 @@
+package io
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// What a connection said and heard, safe to read while it's still talking.
+type transcript struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (t *transcript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Write(p)
+}
+
+func (t *transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.String()
+}
+
+func TestSyncCountsDeletedMessages(t *testing.T) {
+	cfg, be := newTestServer(t)
+	c := connectTestClient(t, cfg)
+	before, err := c.List(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := len(before) - 1
+
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := mailbox.(*memory.Mailbox)
+	// Marked deleted, by someone else, but not expunged.
+	inbox.Messages[0].Flags = append(inbox.Messages[0].Flags, imap.DeletedFlag)
+
+	said := &transcript{}
+	c.mu.Lock()
+	c.in.SetDebug(said)
+	c.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		headers, err := c.List(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(headers) != want {
+			t.Fatalf("listed %d messages, want the %d which aren't deleted", len(headers), want)
+		}
+	}
+	if strings.Contains(strings.ToUpper(said.String()), "SEARCH") {
+		t.Errorf("searched for vanished messages though none vanished:\n%s", said)
+	}
+
+	// Listing again soon after needs only the SELECT, to see that nothing changed.
+	said = &transcript{}
+	c.mu.Lock()
+	c.in.SetDebug(said)
+	c.mu.Unlock()
+	if headers, err := c.List(false); err != nil || len(headers) != want {
+		t.Fatalf("List = %d headers, %v; want %d", len(headers), err, want)
+	}
+	if got := commandsIn(said.String()); strings.Join(got, " ") != "SELECT" {
+		t.Errorf("listed with %v, want a lone SELECT", got)
+	}
+
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	if headers, err := c.List(true); err != nil || len(headers) != want {
+		t.Fatalf("List after expunging = %d headers, %v; want %d", len(headers), err, want)
+	}
+	if len(c.deleted) != 0 {
+		t.Errorf("still counting %d deleted messages after they were expunged", len(c.deleted))
+	}
+}
+
+// The names of the commands a client sent, in order, from its transcript.
+func commandsIn(transcript string) []string {
+	var names []string
+	for _, line := range strings.Split(transcript, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] != "*" && fields[0] != "+" && fields[1] != "OK" && fields[1] != "NO" && fields[1] != "BAD" {
+			names = append(names, strings.ToUpper(fields[1]))
+		}
+	}
+	return names
+}
@@ -0,0 +1,142 @@
+package io
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+
+	jkmemail "github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Threading messages into conversations.
+//
+// Servers with THREAD=REFERENCES do it for us; go-imap doesn't know the command, so we speak it ourselves.
+// See RFC 5256 section 4. Everywhere else, we thread the cached headers locally.
+
+// A THREAD command for the undeleted messages, by the REFERENCES algorithm.
+type threadCommand struct{}
+
+func (cmd *threadCommand) Command() *imap.Command {
+	return &imap.Command{
+		Name: "THREAD",
+		Arguments: []interface{}{
+			imap.RawString("REFERENCES"),
+			imap.RawString("UTF-8"),
+			imap.RawString("UNDELETED"),
+		},
+	}
+}
+
+// Collects the threads from a THREAD response.
+type threadResponse struct {
+	threads []jkmemail.Thread
+}
+
+func (r *threadResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "THREAD" {
+		return responses.ErrUnhandled
+	}
+	for _, field := range fields {
+		list, ok := field.([]interface{})
+		if !ok {
+			return fmt.Errorf("thread is not a list: %v", field)
+		}
+		thread, err := parseThread(list)
+		if err != nil {
+			return err
+		}
+		r.threads = append(r.threads, thread)
+	}
+	return nil
+}
+
+// Parse a thread, e.g. (3 6 (4 23)(44 7 96)).
+// Each number replies to the one before it, and each nested list is a reply to the last number.
+// A list starting with a nested list has a missing message at its root.
+func parseThread(list []interface{}) (jkmemail.Thread, error) {
+	root := jkmemail.Thread{}
+	// The path of reply indices from the root to the last message read.
+	path := []int{}
+	last := func() *jkmemail.Thread {
+		thread := &root
+		for _, i := range path {
+			thread = &thread.Replies[i]
+		}
+		return thread
+	}
+	hasRoot := false
+
+	for _, field := range list {
+		if sublist, ok := field.([]interface{}); ok {
+			reply, err := parseThread(sublist)
+			if err != nil {
+				return root, err
+			}
+			parent := last()
+			parent.Replies = append(parent.Replies, reply)
+			continue
+		}
+
+		uid, err := imap.ParseNumber(field)
+		if err != nil {
+			return root, err
+		}
+		if !hasRoot {
+			root.ID = int(uid)
+			hasRoot = true
+			continue
+		}
+		parent := last()
+		parent.Replies = append(parent.Replies, jkmemail.Thread{ID: int(uid)})
+		path = append(path, len(parent.Replies)-1)
+	}
+	return root, nil
+}
+
+// The selected mailbox's messages, threaded into conversations with the newest first.
+func (c *Client) Threads() ([]jkmemail.Thread, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	defer func() {
+		if err != nil {
+			log.Errorf("Failed to thread messages: %v", err)
+		}
+	}()
+	err = c.ensureConnected()
+	if err != nil {
+		// The cached headers are enough to thread without the server.
+		if c.uidValidity != 0 {
+			log.Warnf("Threading %s locally while offline: %v", c.mailbox, err)
+			err = nil
+			return jkmemail.ThreadHeaders(c.cachedHeaders()), nil
+		}
+		return nil, err
+	}
+
+	headers := c.cachedHeaders()
+	ok, err := c.in.Support("THREAD=REFERENCES")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return jkmemail.ThreadHeaders(headers), nil
+	}
+
+	response := &threadResponse{}
+	status, threadErr := c.in.Execute(&commands.Uid{Cmd: &threadCommand{}}, response)
+	if threadErr == nil {
+		threadErr = status.Err()
+	}
+	if threadErr != nil {
+		// The headers we have are enough to thread without the server.
+		log.Warnf("Server failed to thread messages, threading them locally: %v", threadErr)
+		return jkmemail.ThreadHeaders(headers), nil
+	}
+	jkmemail.SortThreads(response.threads, headers)
+	return response.threads, nil
+}
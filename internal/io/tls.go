@@ -0,0 +1,124 @@
+package io
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	imapClient "github.com/emersion/go-imap/client"
+
+	"github.com/jcc333/jkm/internal/configure"
+	jkmemail "github.com/jcc333/jkm/internal/email"
+)
+
+// Securing connections to the servers.
+//
+// Certificates are verified against the system's authorities and any in the configured CA bundle,
+// unless certificates are pinned, in which case a server must present one of those and nothing else matters.
+// We verify them ourselves rather than leaving it to crypto/tls, so that a failure comes back as a
+// `jkmemail.CertificateError` with the certificates attached, for the user to inspect.
+
+// The TLS configuration for connections to the named server.
+func (c *Client) tlsConfig(serverName string) (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if c.cfg.CABundle != "" {
+		pem, err := os.ReadFile(c.cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.cfg.CABundle)
+		}
+	}
+
+	pins := make(map[string]bool, len(c.cfg.PinnedCertificates))
+	for _, pin := range c.cfg.PinnedCertificates {
+		pins[normalizeFingerprint(pin)] = true
+	}
+
+	return &tls.Config{
+		ServerName: serverName,
+		// Verified below instead, to keep the certificates when they can't be trusted.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			err := verifyCertificates(state.PeerCertificates, serverName, roots, pins)
+			if err != nil {
+				return &jkmemail.CertificateError{Host: serverName, Certificates: state.PeerCertificates, Err: err}
+			}
+			return nil
+		},
+	}, nil
+}
+
+// Check that a server's certificates can be trusted, as crypto/tls would but for pinning.
+func verifyCertificates(certs []*x509.Certificate, serverName string, roots *x509.CertPool, pins map[string]bool) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates presented")
+	}
+	if len(pins) > 0 {
+		for _, cert := range certs {
+			if pins[normalizeFingerprint(jkmemail.Fingerprint(cert))] {
+				return nil
+			}
+		}
+		return fmt.Errorf("none of the certificates presented are pinned")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// A fingerprint in one form, whether written with colons or without, in upper or lower case.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// Dial the IMAP server, secured as configured, without logging in.
+func (c *Client) dialIMAP() (*imapClient.Client, error) {
+	addr := fmt.Sprintf("%s:%d", c.cfg.IMAPServer, c.cfg.IMAPPort)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	security := c.cfg.IMAPConnectionSecurity()
+	if security == configure.NoSecurity {
+		return imapClient.DialWithDialer(dialer, addr)
+	}
+
+	tlsConfig, err := c.tlsConfig(c.cfg.IMAPServer)
+	if err != nil {
+		return nil, err
+	}
+	if security == configure.ImplicitTLS {
+		return imapClient.DialWithDialerTLS(dialer, addr, tlsConfig)
+	}
+
+	conn, err := imapClient.DialWithDialer(dialer, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Carrying on in plaintext when STARTTLS was asked for would give the password away.
+	ok, err := conn.SupportStartTLS()
+	if err == nil && !ok {
+		err = fmt.Errorf("%s doesn't offer STARTTLS", c.cfg.IMAPServer)
+	}
+	if err == nil {
+		err = conn.StartTLS(tlsConfig)
+	}
+	if err != nil {
+		conn.Logout()
+		return nil, err
+	}
+	return conn, nil
+}
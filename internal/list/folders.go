@@ -0,0 +1,131 @@
+package list
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jcc333/jkm/internal/email"
+)
+
+// The folder pane, which sits beside the message list and picks the mailbox to list.
+// It can be collapsed out of the way, and shows the hierarchy of mailboxes by indentation.
+
+// The width of the folder pane, including its border.
+const folderPaneWidth = 30
+
+var (
+	folderPaneStyle = lipgloss.NewStyle().
+			BorderStyle(lipgloss.RoundedBorder()).
+			BorderForeground(lipgloss.Color("240")).
+			Padding(0, 1)
+
+	focusedFolderPaneStyle = folderPaneStyle.
+				BorderForeground(lipgloss.Color("205"))
+
+	folderCursorStyle   = lipgloss.NewStyle().Reverse(true)
+	selectedFolderStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("205"))
+	unselectableStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
+)
+
+// The folder pane's state.
+type folderPane struct {
+	// The mailboxes on the server.
+	mailboxes []email.Mailbox
+
+	// The name of the mailbox being listed.
+	selected string
+
+	// The index of the mailbox under the cursor.
+	cursor int
+
+	// Whether the pane is shown at all.
+	isOpen bool
+}
+
+// Replace the mailboxes, keeping the cursor on the same mailbox where possible.
+func (p *folderPane) setMailboxes(mailboxes []email.Mailbox, selected string) {
+	var current string
+	if p.cursor < len(p.mailboxes) {
+		current = p.mailboxes[p.cursor].Name
+	} else {
+		current = selected
+	}
+
+	p.mailboxes = mailboxes
+	p.selected = selected
+	p.cursor = 0
+	for i, mailbox := range mailboxes {
+		if mailbox.Name == current {
+			p.cursor = i
+			break
+		}
+	}
+}
+
+// Move the cursor by delta, staying within the mailboxes.
+func (p *folderPane) move(delta int) {
+	p.cursor += delta
+	if p.cursor >= len(p.mailboxes) {
+		p.cursor = len(p.mailboxes) - 1
+	}
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+}
+
+// The mailbox under the cursor, if it can be listed.
+func (p folderPane) current() (email.Mailbox, bool) {
+	if p.cursor >= len(p.mailboxes) {
+		return email.Mailbox{}, false
+	}
+	mailbox := p.mailboxes[p.cursor]
+	return mailbox, mailbox.Selectable()
+}
+
+// Render the pane to fill the given height.
+func (p folderPane) View(height int, isFocused bool) string {
+	style := folderPaneStyle
+	if isFocused {
+		style = focusedFolderPaneStyle
+	}
+	// Account for the border.
+	rows := height - 2
+	if rows < 1 {
+		rows = 1
+	}
+	innerWidth := folderPaneWidth - style.GetHorizontalFrameSize()
+
+	lines := []string{selectedFolderStyle.Render("Folders")}
+	if len(p.mailboxes) == 0 {
+		lines = append(lines, unselectableStyle.Render("Loading..."))
+	}
+
+	// Scroll so the cursor is always visible beneath the title.
+	first := 0
+	if p.cursor >= rows-1 {
+		first = p.cursor - (rows - 2)
+	}
+	for i := first; i < len(p.mailboxes) && len(lines) < rows; i++ {
+		mailbox := p.mailboxes[i]
+		line := strings.Repeat("  ", mailbox.Depth()) + mailbox.Leaf()
+		if mailbox.Unread > 0 {
+			line = fmt.Sprintf("%s (%d)", line, mailbox.Unread)
+		}
+		if runes := []rune(line); len(runes) > innerWidth {
+			line = string(runes[:innerWidth-1]) + "…"
+		}
+
+		switch {
+		case isFocused && i == p.cursor:
+			line = folderCursorStyle.Render(line)
+		case mailbox.Name == p.selected:
+			line = selectedFolderStyle.Render(line)
+		case !mailbox.Selectable():
+			line = unselectableStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+
+	return style.Width(innerWidth + style.GetHorizontalPadding()).Height(rows).Render(strings.Join(lines, "\n"))
+}
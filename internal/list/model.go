@@ -2,10 +2,17 @@ package list
 
 import (
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/charmbracelet/bubbles/list"
+	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jcc333/jkm/internal/chooser"
+	"github.com/jcc333/jkm/internal/commands"
+	"github.com/jcc333/jkm/internal/configure"
 	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/log"
 	"github.com/jcc333/jkm/internal/messages"
@@ -22,61 +29,456 @@ import (
 // - as composer
 // - an error-handler
 
-// Read/unread status of messages
-type status int
+var searchErrStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+
+// How the state of the connection is shown in the status bar.
+var connectionStyles = map[email.ConnectionState]lipgloss.Style{
+	email.Connected:    lipgloss.NewStyle().Foreground(lipgloss.Color("10")),
+	email.Reconnecting: lipgloss.NewStyle().Foreground(lipgloss.Color("11")),
+	email.Offline:      lipgloss.NewStyle().Foreground(lipgloss.Color("9")),
+}
 
 const (
-	unread status = iota
-	read
+	// How long being connected again is shown for.
+	connectedLifetime = 3 * time.Second
+
+	// Connection problems are shown until they're over.
+	problemLifetime = 24 * time.Hour
+
+	// The most messages around the cursor fetched ahead of being read.
+	prefetchLimit = 10
 )
 
 // The model for a list of emails.
 type listingModel struct {
 	// The underlying list.
 	list list.Model
-	// If the list is currently being updated.
+
+	// The folder pane beside the list.
+	folders folderPane
+
+	// Whether keys go to the folder pane rather than the list.
+	isFolderFocused bool
+
+	// The size of the whole view.
+	width, height int
+
+	// Email client for acting on messages.
+	receiver email.Receiver
+
+	// Picks the mailbox to move a message to.
+	chooser chooser.Model
+
+	// Whether the chooser is open, and so has the keys.
+	isChoosing bool
+
+	// The ID of the message being moved.
+	movingID int
+
+	// The (global) configuration settings, which say whether the list is threaded.
+	cfg *configure.Config
+
+	// The headers of the messages in the mailbox, newest first.
+	headers []*email.MessageHeader
+
+	// The messages grouped into conversations, for the threaded view.
+	threads []email.Thread
+
+	// The threads collapsed to their first message, by that message's ID.
+	collapsed map[int]bool
+
+	// The name of the mailbox being listed.
+	mailbox string
+
+	// Where the user types a search.
+	searchInput textinput.Model
+
+	// Whether the search input is open, and so has the keys.
+	isTyping bool
+
+	// Why the last search typed couldn't be run, if it couldn't.
+	searchErr error
+
+	// The search whose results are listed in place of the mailbox, if any.
+	search string
+
+	// The headers of the messages the search found, newest first.
+	results []*email.MessageHeader
+
+	// The ID of the message the messages around which were last prefetched.
+	prefetchedID int
+}
+
+// Renders unread messages in bold, and otherwise like the default delegate.
+type emailDelegate struct {
+	list.DefaultDelegate
+}
+
+// Render a list item.
+func (d emailDelegate) Render(w io.Writer, m list.Model, index int, item list.Item) {
+	delegate := d.DefaultDelegate
+	if item, ok := item.(emailItem); ok && item.isUnread() {
+		delegate.Styles.NormalTitle = delegate.Styles.NormalTitle.Bold(true)
+		delegate.Styles.SelectedTitle = delegate.Styles.SelectedTitle.Bold(true)
+	}
+	delegate.Render(w, m, index, item)
 }
 
 // A list item for the `listingModel`.
 // Contains an email header and implements `list.Item`.
 type emailItem struct {
 	header *email.MessageHeader
+
+	// How deep in replies the message is, in the threaded view.
+	depth int
+
+	// The ID of the first message in the message's thread, in the threaded view.
+	threadID int
+
+	// The number of messages in the thread, for the first message in one.
+	threadSize int
+
+	// Whether the thread is collapsed to this, its first message.
+	isCollapsed bool
+
+	// Whether any message in the thread is unread, for the first message in one.
+	hasUnread bool
 }
 
-// A list-item's title.
+// Whether to show the item as unread: a collapsed thread is, if anything in it is.
+func (i emailItem) isUnread() bool {
+	return !i.header.Flags.Has(email.Seen) || i.isCollapsed && i.hasUnread
+}
+
+// A list-item's title, marked if the message is starred.
+// In the threaded view, replies are indented and threads show whether they're collapsed and how long they are.
 func (i emailItem) Title() string {
-	return i.header.Subject
+	title := i.header.Subject
+	if i.header.Flags.Has(email.Flagged) {
+		title = "★ " + title
+	}
+	switch {
+	case i.threadSize > 1 && i.isCollapsed:
+		title = fmt.Sprintf("▸ %s (%d)", title, i.threadSize)
+	case i.threadSize > 1:
+		title = fmt.Sprintf("▾ %s (%d)", title, i.threadSize)
+	case i.depth > 0:
+		title = strings.Repeat("  ", i.depth-1) + "↳ " + title
+	}
+	return title
 }
 
 // A list-item's description.
 func (i emailItem) Description() string {
-	return fmt.Sprintf("From: %s | %s", i.header.From, i.header.Date.Format(time.DateTime))
+	description := fmt.Sprintf("From: %s | %s", i.header.From, i.header.Date.Format(time.DateTime))
+	if i.depth > 0 {
+		description = strings.Repeat("  ", i.depth) + description
+	}
+	return description
 }
 
 // A list-item's search value.
 func (i emailItem) FilterValue() string {
-	return i.header.Subject + " " + i.header.From + " " + i.header.Date.Format(time.DateTime)
+	return i.header.Subject + " " + i.header.From.String() + " " + i.header.Date.Format(time.DateTime)
 }
 
 // Make a new mailer with the given index selected.
-func New(items []*email.MessageHeader) *listingModel {
-	delegate := list.NewDefaultDelegate()
+func New(cfg *configure.Config, receiver email.Receiver, items []*email.MessageHeader) *listingModel {
+	delegate := emailDelegate{list.NewDefaultDelegate()}
 	listModel := list.New([]list.Item{}, delegate, 0, 0)
-	listModel.Title = "JKM Email Client"
+	listModel.Title = title(email.Inbox, "")
 	listModel.SetShowHelp(false)
 	listModel.SetShowStatusBar(true)
 	listModel.SetFilteringEnabled(true)
+	// "f" opens the folder pane and "u" marks messages unread, so they can't page too.
+	listModel.KeyMap.NextPage.SetKeys("right", "l", "pgdown")
+	listModel.KeyMap.PrevPage.SetKeys("left", "h", "pgup", "b")
+	// "/" searches the server, so filtering what's loaded moves aside.
+	listModel.KeyMap.Filter.SetKeys("ctrl+f")
+
+	searchInput := textinput.New()
+	searchInput.Prompt = "Search: "
+	searchInput.Placeholder = `from:alice subject:"deploy" since:2025-01-01 is:unread has:attachment`
+
+	m := &listingModel{
+		list:        listModel,
+		receiver:    receiver,
+		cfg:         cfg,
+		headers:     items,
+		collapsed:   map[int]bool{},
+		mailbox:     email.Inbox,
+		searchInput: searchInput,
+	}
+	m.list.SetItems(m.items())
+	return m
+}
+
+// The list's title for the given mailbox, and the search listed in its place if there is one.
+func title(mailbox, search string) string {
+	if search != "" {
+		return fmt.Sprintf("JKM Email Client: %s, searching %s", mailbox, search)
+	}
+	return fmt.Sprintf("JKM Email Client: %s", mailbox)
+}
+
+// Show how the connection stands in the status bar.
+// Problems stay until we're connected again, which is shown briefly before the status bar goes back to normal.
+func (m *listingModel) showConnection(msg messages.ConnectionChanged) tea.Cmd {
+	status := msg.State.String()
+	switch msg.State {
+	case email.Connected:
+		m.list.StatusMessageLifetime = connectedLifetime
+	case email.Offline:
+		status = fmt.Sprintf("offline, showing what we have; retrying at %s", msg.Retry.Format(time.TimeOnly))
+		if msg.Retry.IsZero() {
+			status = fmt.Sprintf("offline, showing what we have; not retrying: %v", msg.Err)
+		}
+		m.list.StatusMessageLifetime = problemLifetime
+	default:
+		status = fmt.Sprintf("reconnecting at %s", msg.Retry.Format(time.TimeOnly))
+		m.list.StatusMessageLifetime = problemLifetime
+	}
+	return m.list.NewStatusMessage(connectionStyles[msg.State].Render("● " + status))
+}
+
+// Size the list to whatever the folder pane leaves of the view.
+func (m *listingModel) resize() {
+	width := m.width
+	if m.folders.isOpen {
+		width -= folderPaneWidth
+	}
+	height := m.height
+	if m.isTyping {
+		height -= lipgloss.Height(m.searchView())
+	}
+	m.list.SetSize(width, height)
+}
+
+// The list items for the mailbox or the search results, threaded or not.
+func (m listingModel) items() []list.Item {
+	headers := m.headers
+	if m.search != "" {
+		headers = m.results
+	}
+	if m.cfg.Threaded && m.threads != nil {
+		return threadItems(m.threads, headers, m.collapsed)
+	}
+	items := make([]list.Item, len(headers))
+	for i, header := range headers {
+		items[i] = emailItem{header: header}
+	}
+	return items
+}
+
+// Select the item for the message with the given ID, if it's listed.
+func (m *listingModel) selectID(id int) bool {
+	for i, item := range m.list.Items() {
+		if item, ok := item.(emailItem); ok && item.header.ID == id {
+			m.list.Select(i)
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the list's items, keeping the same message selected where possible.
+func (m *listingModel) setItems(items []list.Item) {
+	var selectedHeader *email.MessageHeader
+	idx := m.list.Index()
+
+	log.Warnf("idx = %v", idx)
+	if idx >= 0 && idx < len(m.list.Items()) {
+		if item, ok := m.list.SelectedItem().(emailItem); ok {
+			selectedHeader = item.header
+		}
+	}
+	log.Warnf("selected header = %v", selectedHeader)
+
+	log.Warnf("about to set items %d", len(items))
+
+	m.list.SetItems(items)
+	log.Warnf("set items %d", len(items))
+
+	if selectedHeader != nil && len(items) > 0 {
+		log.Warnf("have a selected header with Id %d and %d items", selectedHeader.ID, len(items))
+		isFound := false
+
+		for i, item := range items {
+			if emailItem, ok := item.(emailItem); ok {
+				if emailItem.header.ID == selectedHeader.ID {
+					log.Warnf("selecting item %d with ID %d", i, emailItem.header.ID)
+					m.list.Select(i)
+					isFound = true
+					break
+				}
+			}
+		}
+
+		if !isFound {
+			if idx < len(items) {
+				log.Warnf("falling back to item at same index")
+				m.list.Select(idx)
+			} else if len(items) > 0 {
+				log.Warnf("falling back to last item")
+				m.list.Select(len(items) - 1)
+			}
+		}
+	} else if len(items) > 0 {
+		// Ensure there's always a selection if there are items
+		log.Warnf("falling back to first item")
+		m.list.Select(0)
+	}
+}
+
+// The IDs of the messages on the cursor's page, nearest the cursor first.
+func (m listingModel) nearby() []int {
+	items := m.list.VisibleItems()
+	start, end := m.list.Paginator.GetSliceBounds(len(items))
+	cursor := m.list.Index()
+	order := []int{cursor}
+	for d := 1; d < end-start; d++ {
+		order = append(order, cursor+d, cursor-d)
+	}
+
+	ids := []int{}
+	for _, i := range order {
+		if i < start || i >= end {
+			continue
+		}
+		if item, ok := items[i].(emailItem); ok {
+			ids = append(ids, item.header.ID)
+		}
+		if len(ids) == prefetchLimit {
+			break
+		}
+	}
+	return ids
+}
+
+// Prefetch the messages around the cursor, if it has moved since they last were.
+func (m *listingModel) prefetch() tea.Cmd {
+	prefetcher, ok := m.receiver.(email.Prefetcher)
+	if !ok {
+		return nil
+	}
+	item, ok := m.list.SelectedItem().(emailItem)
+	if !ok || item.header.ID == m.prefetchedID {
+		return nil
+	}
+	m.prefetchedID = item.header.ID
+	return commands.Prefetch(prefetcher, m.nearby())
+}
+
+// Remove a message from the list.
+func (m *listingModel) remove(id int) {
+	for i, header := range m.headers {
+		if header.ID == id {
+			m.headers = append(m.headers[:i:i], m.headers[i+1:]...)
+			break
+		}
+	}
+	for i, header := range m.results {
+		if header.ID == id {
+			m.results = append(m.results[:i:i], m.results[i+1:]...)
+			break
+		}
+	}
+	for i, item := range m.list.Items() {
+		if item, ok := item.(emailItem); ok && item.header.ID == id {
+			m.list.RemoveItem(i)
+			break
+		}
+	}
+}
 
-	listItems := make([]list.Item, len(items))
-	for i, header := range items {
-		listItems[i] = emailItem{header: header}
+// Handle messages while the user types a search.
+// The query is checked before it's sent, so mistakes can be fixed in place.
+func (m listingModel) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c":
+		return m, tea.Quit
+	case "esc":
+		m.isTyping = false
+		m.searchErr = nil
+		m.searchInput.Blur()
+		m.resize()
+		return m, nil
+	case "enter":
+		text := strings.TrimSpace(m.searchInput.Value())
+		if _, err := email.ParseQuery(text); err != nil {
+			m.searchErr = err
+			m.resize()
+			return m, nil
+		}
+		m.isTyping = false
+		m.searchErr = nil
+		m.searchInput.Blur()
+		m.resize()
+		return m, commands.SearchEmails(m.receiver, text)
 	}
 
-	listModel.SetItems(listItems)
+	var cmd tea.Cmd
+	m.searchInput, cmd = m.searchInput.Update(msg)
+	return m, cmd
+}
 
-	return &listingModel{
-		list: listModel,
+// Render the search input, with why the last search couldn't be run.
+func (m listingModel) searchView() string {
+	view := m.searchInput.View()
+	if m.searchErr != nil {
+		view += "\n" + searchErrStyle.Render(m.searchErr.Error())
 	}
+	return view
+}
+
+// Handle keys while the folder pane has focus.
+func (m listingModel) updateFolders(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "j", "down":
+		m.folders.move(1)
+	case "k", "up":
+		m.folders.move(-1)
+	case "tab", "esc":
+		m.isFolderFocused = false
+	case "f":
+		m.folders.isOpen = false
+		m.isFolderFocused = false
+		m.resize()
+	case "ctrl+c", "q":
+		return m, tea.Quit
+	case "enter":
+		if mailbox, ok := m.folders.current(); ok {
+			m.isFolderFocused = false
+			return m, commands.SelectMailbox(mailbox.Name)
+		}
+	}
+	return m, nil
+}
+
+// Handle messages while choosing a mailbox to move a message to.
+func (m listingModel) updateChooser(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.resize()
+	case messages.RemovedEmail:
+		m.remove(msg.ID)
+		return m, nil
+
+	case messages.FetchedMailboxes:
+		m.folders.setMailboxes(msg.Mailboxes, msg.Selected)
+	}
+
+	var cmd tea.Cmd
+	m.chooser, cmd = m.chooser.Update(msg)
+	switch {
+	case m.chooser.IsCancelled:
+		m.isChoosing = false
+	case m.chooser.Chosen != "":
+		m.isChoosing = false
+		return m, commands.MoveEmail(m.receiver, m.movingID, m.chooser.Chosen)
+	}
+	return m, cmd
 }
 
 // Set up the list model.
@@ -86,69 +488,133 @@ func (m listingModel) Init() tea.Cmd {
 
 // List model update method.
 func (m listingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	// The connection's state is shown whatever we're doing.
+	if msg, ok := msg.(messages.ConnectionChanged); ok {
+		return m, m.showConnection(msg)
+	}
+	if m.isChoosing {
+		return m.updateChooser(msg)
+	}
+
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
-		h, v := 0, 0
-		m.list.SetSize(msg.Width-h, msg.Height-v)
+		m.width, m.height = msg.Width, msg.Height
+		m.resize()
+		// Resizing changes which messages are on the cursor's page.
+		m.prefetchedID = 0
+		return m, m.prefetch()
+
+	case messages.FlagSet:
+		for _, item := range m.list.Items() {
+			if item, ok := item.(emailItem); ok && item.header.ID == msg.ID {
+				item.header.Flags = item.header.Flags.With(msg.Flag, msg.On)
+			}
+		}
+		// Collapsed threads show whether anything in them is unread.
+		if m.cfg.Threaded {
+			m.setItems(m.items())
+		}
+		return m, nil
+
+	case messages.RemovedEmail:
+		m.remove(msg.ID)
+		return m, nil
+
+	case messages.FetchedMailboxes:
+		m.folders.setMailboxes(msg.Mailboxes, msg.Selected)
+		m.mailbox = msg.Selected
+		m.list.Title = title(m.mailbox, m.search)
+		return m, nil
+
+	case messages.SearchedEmails:
+		m.search = msg.Query
+		m.results = msg.Items
+		m.list.Title = title(m.mailbox, m.search)
+		m.setItems(m.items())
+		return m, nil
+
+	case messages.ClearedSearch:
+		m.search = ""
+		m.results = nil
+		m.list.Title = title(m.mailbox, m.search)
+		m.setItems(m.items())
 		return m, nil
 
 	case messages.RefreshedEmails:
 		log.Warnf("Refreshing emails in list with %d messages", len(msg.Items))
-		var selectedHeader *email.MessageHeader
-		idx := m.list.Index()
+		m.headers = msg.Items
+		// Search results stay put until the search is cleared.
+		if m.search == "" {
+			m.setItems(m.items())
+		}
+		log.Warnf("returning model")
+		if m.cfg.Threaded {
+			return m, tea.Batch(tea.WindowSize(), commands.FetchThreads(m.receiver))
+		}
+		return m, tea.WindowSize()
 
-		log.Warnf("idx = %v", idx)
-		if idx >= 0 && idx < len(m.list.Items()) {
-			if item, ok := m.list.SelectedItem().(emailItem); ok {
-				selectedHeader = item.header
-			}
+	case messages.FetchedThreads:
+		m.threads = msg.Threads
+		if m.cfg.Threaded {
+			m.setItems(m.items())
 		}
-		log.Warnf("selected header = %v", selectedHeader)
+		return m, nil
 
-		items := make([]list.Item, len(msg.Items))
-		for i, header := range msg.Items {
-			items[i] = emailItem{header: header}
+	case tea.KeyMsg:
+		// Keys belong to the filter while the user is typing one.
+		if m.list.FilterState() == list.Filtering {
+			break
 		}
-		log.Warnf("about to set items %d", len(items))
+		if m.isTyping {
+			return m.updateSearch(msg)
+		}
+		if m.isFolderFocused {
+			return m.updateFolders(msg)
+		}
+
+		switch msg.String() {
+		case "f":
+			m.folders.isOpen = !m.folders.isOpen
+			m.isFolderFocused = m.folders.isOpen
+			m.resize()
+			return m, nil
 
-		m.list.SetItems(items)
-		log.Warnf("set items %d", len(items))
+		case "tab":
+			if m.folders.isOpen {
+				m.isFolderFocused = true
+				return m, nil
+			}
 
-		if selectedHeader != nil && len(items) > 0 {
-			log.Warnf("have a selected header with Id %d and %d items", selectedHeader.ID, len(items))
-			isFound := false
+		case "/":
+			m.isTyping = true
+			m.searchErr = nil
+			m.searchInput.SetValue(m.search)
+			m.searchInput.CursorEnd()
+			m.resize()
+			return m, m.searchInput.Focus()
 
-			for i, item := range items {
-				if emailItem, ok := item.(emailItem); ok {
-					if emailItem.header.ID == selectedHeader.ID {
-						log.Warnf("selecting item %d with ID %d", i, emailItem.header.ID)
-						m.list.Select(i)
-						isFound = true
-						break
-					}
-				}
+		case "esc":
+			if m.search != "" {
+				return m, commands.ClearSearch()
 			}
 
-			if !isFound {
-				if idx < len(items) {
-					log.Warnf("falling back to item at same index")
-					m.list.Select(idx)
-				} else if len(items) > 0 {
-					log.Warnf("falling back to last item")
-					m.list.Select(len(items) - 1)
-				}
+		case "t":
+			m.cfg.Threaded = !m.cfg.Threaded
+			m.setItems(m.items())
+			if m.cfg.Threaded {
+				return m, commands.FetchThreads(m.receiver)
 			}
-		} else if len(items) > 0 {
-			// Ensure there's always a selection if there are items
-			log.Warnf("falling back to first item")
-			m.list.Select(0)
-		}
+			return m, nil
 
-		log.Warnf("returning model")
-		return m, tea.WindowSize()
+		case " ":
+			if item, ok := m.list.SelectedItem().(emailItem); ok && m.cfg.Threaded && item.threadID != 0 {
+				m.collapsed[item.threadID] = !m.collapsed[item.threadID]
+				m.setItems(m.items())
+				// Collapsing from a reply leaves the thread's first message in its place.
+				m.selectID(item.threadID)
+			}
+			return m, nil
 
-	case tea.KeyMsg:
-		switch msg.String() {
 		case "enter":
 			item, ok := m.list.SelectedItem().(emailItem)
 			if ok {
@@ -164,14 +630,52 @@ func (m listingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, tea.Batch(
 				func() tea.Msg { return messages.ComposeMessage{} },
 			)
+
+		case "u":
+			if item, ok := m.list.SelectedItem().(emailItem); ok {
+				return m, commands.SetFlag(m.receiver, item.header.ID, email.Seen, !item.header.Flags.Has(email.Seen))
+			}
+
+		case "s":
+			if item, ok := m.list.SelectedItem().(emailItem); ok {
+				return m, commands.SetFlag(m.receiver, item.header.ID, email.Flagged, !item.header.Flags.Has(email.Flagged))
+			}
+
+		case "d":
+			if item, ok := m.list.SelectedItem().(emailItem); ok {
+				return m, commands.DeleteEmail(m.receiver, item.header.ID)
+			}
+
+		case "a":
+			if item, ok := m.list.SelectedItem().(emailItem); ok {
+				return m, commands.ArchiveEmail(m.receiver, item.header.ID)
+			}
+
+		case "m":
+			if item, ok := m.list.SelectedItem().(emailItem); ok {
+				m.movingID = item.header.ID
+				m.chooser = chooser.New(m.receiver, fmt.Sprintf("Move %q to...", item.header.Subject))
+				m.isChoosing = true
+				return m, m.chooser.Init()
+			}
 		}
 	}
 
 	var cmd tea.Cmd
 	m.list, cmd = m.list.Update(msg)
-	return m, cmd
+	return m, tea.Batch(cmd, m.prefetch())
 }
 
 func (m listingModel) View() string {
-	return m.list.View()
+	if m.isChoosing {
+		return m.chooser.View()
+	}
+	view := m.list.View()
+	if m.isTyping {
+		view = lipgloss.JoinVertical(lipgloss.Left, m.searchView(), view)
+	}
+	if !m.folders.isOpen {
+		return view
+	}
+	return lipgloss.JoinHorizontal(lipgloss.Top, m.folders.View(m.height, m.isFolderFocused), view)
 }
@@ -0,0 +1,57 @@
+package list
+
+import (
+	"github.com/charmbracelet/bubbles/list"
+	"github.com/jcc333/jkm/internal/email"
+)
+
+// The threaded view of the list, where conversations are grouped together.
+// Each thread is headed by its first message, with the replies beneath it indented by depth.
+// A thread can be collapsed down to its head, which then shows how many messages it holds.
+
+// The list items for the given threads, leaving out the replies in collapsed ones.
+// Messages we have no header for, e.g. ones which arrived since the last refresh, are left out too.
+func threadItems(threads []email.Thread, headers []*email.MessageHeader, collapsed map[int]bool) []list.Item {
+	byID := make(map[int]*email.MessageHeader, len(headers))
+	for _, header := range headers {
+		byID[header.ID] = header
+	}
+
+	items := []list.Item{}
+	for _, thread := range threads {
+		messages := []emailItem{}
+		thread.Walk(func(id, depth int) {
+			if header, ok := byID[id]; ok {
+				messages = append(messages, emailItem{header: header, depth: depth})
+			}
+		})
+		if len(messages) == 0 {
+			continue
+		}
+
+		head := messages[0]
+		head.depth = 0
+		head.threadID = head.header.ID
+		head.threadSize = len(messages)
+		head.isCollapsed = collapsed[head.threadID]
+		for _, message := range messages {
+			head.hasUnread = head.hasUnread || !message.header.Flags.Has(email.Seen)
+		}
+		items = append(items, head)
+		if head.isCollapsed {
+			continue
+		}
+
+		// Where the thread's root is missing, its replies go beneath the head, the first of them.
+		offset := 0
+		if thread.ID == 0 || messages[0].depth > 0 {
+			offset = 1
+		}
+		for _, message := range messages[1:] {
+			message.threadID = head.threadID
+			message.depth += offset
+			items = append(items, message)
+		}
+	}
+	return items
+}
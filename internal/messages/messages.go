@@ -1,8 +1,6 @@
 package messages
 
 import (
-	"time"
-
 	"github.com/jcc333/jkm/internal/email"
 )
 
@@ -13,15 +11,67 @@ type RefreshedEmails struct {
 	Items []*email.MessageHeader
 }
 
+// The result of asynchronously searching the selected mailbox.
+type SearchedEmails struct {
+	// The query as the user typed it.
+	Query string
+
+	Items []*email.MessageHeader
+}
+
+// ClearedSearch is sent when the user leaves search results to go back to the mailbox.
+type ClearedSearch struct{}
+
+// The result of asynchronously threading the listed emails.
+type FetchedThreads struct {
+	Threads []email.Thread
+}
+
 // The result of asynchronously fetching a single complete email.
 type FetchedOne struct {
 	Message *email.Message
 }
 
-// FetchedBody represents the result of fetching just the body content of a message
-type FetchedBody struct {
+// The result of asynchronously fetching the whole of an email as it was sent.
+type FetchedSource struct {
+	ID     int
+	Source string
+}
+
+// SavedAttachments is sent once attachments have been written to disk.
+type SavedAttachments struct {
+	// Where each attachment was saved.
+	Paths []string
+}
+
+// The result of asynchronously listing the mailboxes.
+type FetchedMailboxes struct {
+	Mailboxes []email.Mailbox
+
+	// The name of the mailbox being listed.
+	Selected string
+}
+
+// SelectMailbox is sent when the user picks a mailbox to work in.
+type SelectMailbox struct {
+	Name string
+}
+
+// SelectedMailbox is sent once the mail layer has switched to a mailbox.
+type SelectedMailbox struct {
+	Name string
+}
+
+// FlagSet is sent once a flag has been set or cleared on a message.
+type FlagSet struct {
 	ID   int
-	Body string
+	Flag email.Flag
+	On   bool
+}
+
+// RemovedEmail is sent once a message has been deleted, archived or moved out of the mailbox.
+type RemovedEmail struct {
+	ID int
 }
 
 // An envelope for an error
@@ -29,8 +79,17 @@ type Err struct {
 	Error error
 }
 
+// Offline is sent in place of what a command couldn't get for want of a connection to the server.
+// The status bar already shows how the connection stands, so this isn't worth interrupting the user for.
+type Offline struct {
+	Error error
+}
+
 // ComposeMessage represents the user composing a message.
-type ComposeMessage struct{}
+type ComposeMessage struct {
+	// What to start from, e.g. a reply, or nothing for a blank message.
+	Draft email.Message
+}
 
 // ListMessages is sent when it's time to show the list view.
 type ListMessages struct{}
@@ -42,7 +101,7 @@ type ReadEmailMessage struct {
 
 // Sent when we send a message.
 type SendEmail struct {
-	Recipient, Subject, Body string
+	Message email.Message
 }
 
 // Sent when we *have sent* a message.
@@ -51,13 +110,28 @@ type SentEmail struct{}
 // SendingEmail is sent when we are in the process of sending a message
 // This triggers showing a spinner overlay
 type SendingEmail struct {
-	Recipient, Subject, Body string
+	Message email.Message
+}
+
+// SaveDraft is sent when the user keeps an unfinished message as a draft.
+type SaveDraft struct {
+	Message email.Message
 }
 
+// SavedDraft is sent once a draft has been saved to the drafts mailbox.
+type SavedDraft struct{}
+
 // SendingFailure is sent when sending a message failed
 type SendingFailure struct {
 	Error error
 }
 
-// A tick event. Used in our case to refresh the email list.
-type Tick time.Time
+// Sent when the server pushes a change to a mailbox. Used in our case to refresh the email list.
+type MailboxUpdated struct {
+	Update email.Update
+}
+
+// Sent when the connection to the server drops or comes back, for the list's status bar.
+type ConnectionChanged struct {
+	email.ConnectionChanged
+}
@@ -0,0 +1,231 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// Signing in with OAuth2, for servers which don't take passwords.
+//
+// The first time, the user authorizes us: either by entering a code we show them on the provider's page,
+// on any device (the device authorization grant, RFC 8628), or in a browser on this machine which the provider
+// sends back to a server of ours on the loopback interface (RFC 8252), with PKCE.
+// The tokens we get are kept in a file only the user can read, so that from then on the refresh token
+// gets us new access tokens without asking them again.
+
+// Returned when we have no token to refresh, and the user has to authorize us again.
+var ErrNotAuthorized = errors.New("not signed in with OAuth2, restart jkm to sign in")
+
+// Source provides access tokens for an account, refreshing and storing them as needed.
+type Source struct {
+	// The OAuth2 client we sign in as, and the provider's endpoints.
+	config *oauth2.Config
+
+	// How the user authorizes us.
+	flow configure.OAuthFlow
+
+	// Where the tokens are kept, or empty not to keep them.
+	path string
+
+	// Where the user is told how to authorize us.
+	prompt io.Writer
+
+	// Held while getting a token, so that it's refreshed once however many want it.
+	mu sync.Mutex
+
+	// The latest token, or nil if we haven't loaded or been given one.
+	token *oauth2.Token
+}
+
+// Get a Source for the configured account, telling the user how to authorize us on prompt.
+func New(cfg *configure.Config, prompt io.Writer) *Source {
+	return &Source{
+		config: &oauth2.Config{
+			ClientID:     cfg.OAuthClientID,
+			ClientSecret: cfg.OAuthClientSecret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:       cfg.OAuthAuthURL,
+				TokenURL:      cfg.OAuthTokenURL,
+				DeviceAuthURL: cfg.OAuthDeviceURL,
+			},
+			Scopes: cfg.OAuthScopes,
+		},
+		flow:   cfg.OAuthFlow,
+		path:   cfg.OAuthTokenPath,
+		prompt: prompt,
+	}
+}
+
+// Make sure we can get tokens, asking the user to authorize us if we can't.
+// Tokens are only refreshed when they're needed, so that this works offline.
+func (s *Source) Authorize(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	if s.token != nil && (s.token.Valid() || s.token.RefreshToken != "") {
+		return nil
+	}
+
+	var token *oauth2.Token
+	var err error
+	switch s.flow {
+	case configure.LoopbackFlow:
+		token, err = s.loopbackFlow(ctx)
+	default:
+		token, err = s.deviceFlow(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("authorizing with OAuth2: %w", err)
+	}
+	return s.save(token)
+}
+
+// A valid access token, refreshed if need be. This never asks the user anything.
+func (s *Source) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	if s.token == nil {
+		return "", ErrNotAuthorized
+	}
+	if s.token.Valid() {
+		return s.token.AccessToken, nil
+	}
+	if s.token.RefreshToken == "" {
+		return "", ErrNotAuthorized
+	}
+
+	// The refresh token is kept if the provider doesn't send a new one.
+	token, err := s.config.TokenSource(ctx, s.token).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			// Revoked or expired, so there's nothing for it but to authorize us again.
+			log.Warnf("OAuth2 refresh token was refused: %v", err)
+			return "", ErrNotAuthorized
+		}
+		return "", fmt.Errorf("refreshing OAuth2 token: %w", err)
+	}
+	if err := s.save(token); err != nil {
+		log.Warnf("Failed to save OAuth2 token: %v", err)
+	}
+	return token.AccessToken, nil
+}
+
+// Ask the user to enter a code on the provider's page, and wait for them to.
+func (s *Source) deviceFlow(ctx context.Context) (*oauth2.Token, error) {
+	response, err := s.config.DeviceAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(s.prompt, "To sign in, visit %s and enter the code %s\n", response.VerificationURI, response.UserCode)
+	return s.config.DeviceAccessToken(ctx, response)
+}
+
+// Ask the user to open the provider's page in a browser, and wait for it to send them back to us.
+func (s *Source) loopbackFlow(ctx context.Context) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	config := *s.config
+	config.RedirectURL = fmt.Sprintf("http://%s/", listener.Addr())
+
+	verifier := oauth2.GenerateVerifier()
+	state := oauth2.GenerateVerifier()
+	codes := make(chan string, 1)
+	failures := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// Anything else is the browser asking for a favicon, or someone else's request.
+		if query.Get("state") != state {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if reason := query.Get("error"); reason != "" {
+			select {
+			case failures <- fmt.Errorf("authorization refused: %s", reason):
+			default:
+			}
+			fmt.Fprintln(w, "jkm wasn't authorized; you can close this window.")
+			return
+		}
+		select {
+		case codes <- query.Get("code"):
+		default:
+		}
+		fmt.Fprintln(w, "jkm is signed in; you can close this window.")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	url := config.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
+	fmt.Fprintf(s.prompt, "To sign in, open this link in your browser:\n\n%s\n\n", url)
+
+	select {
+	case code := <-codes:
+		return config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	case err := <-failures:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Load the stored token, if we haven't got one already.
+func (s *Source) load() error {
+	if s.token != nil || s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading OAuth2 token: %w", err)
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return fmt.Errorf("reading OAuth2 token from %s: %w", s.path, err)
+	}
+	s.token = &token
+	return nil
+}
+
+// Keep a new token, and store it if we can.
+func (s *Source) save(token *oauth2.Token) error {
+	s.token = token
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	// Written aside and renamed into place, so that a crash can't leave us with half a token.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,217 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// A stand-in for a provider's token server, handing out numbered access tokens.
+type tokenServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// How many access tokens have been handed out.
+	issued int
+	// Whether the device code has been entered yet.
+	entered bool
+	// The refresh token it takes.
+	refreshToken string
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	s := &tokenServer{refreshToken: "refresh-1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": s.URL + "/activate",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if !s.entered {
+				s.entered = true
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "authorization_pending"})
+				return
+			}
+		case "authorization_code":
+			if r.Form.Get("code") != "auth-code" || r.Form.Get("code_verifier") == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+				return
+			}
+		case "refresh_token":
+			if r.Form.Get("refresh_token") != s.refreshToken {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid_grant"})
+				return
+			}
+		}
+		s.issued++
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token":  "access-" + string(rune('0'+s.issued)),
+			"token_type":    "Bearer",
+			"refresh_token": s.refreshToken,
+			"expires_in":    3600,
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func testConfig(s *tokenServer, flow configure.OAuthFlow, path string) *configure.Config {
+	return &configure.Config{
+		Auth:           configure.XOAuth2Auth,
+		OAuthClientID:  "jkm",
+		OAuthAuthURL:   s.URL + "/authorize",
+		OAuthTokenURL:  s.URL + "/token",
+		OAuthDeviceURL: s.URL + "/device",
+		OAuthScopes:    []string{"mail"},
+		OAuthFlow:      flow,
+		OAuthTokenPath: path,
+	}
+}
+
+func TestDeviceFlowStoresAndRefreshesToken(t *testing.T) {
+	log.Init(false)
+	server := newTokenServer(t)
+	path := filepath.Join(t.TempDir(), "jkm", "token.json")
+	var prompt bytes.Buffer
+	source := New(testConfig(server, configure.DeviceFlow, path), &prompt)
+
+	ctx := context.Background()
+	if err := source.Authorize(ctx); err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if !strings.Contains(prompt.String(), "ABCD-EFGH") {
+		t.Errorf("prompt %q doesn't show the user code", prompt.String())
+	}
+	token, err := source.Token(ctx)
+	if err != nil || token != "access-1" {
+		t.Fatalf("Token = %q, %v, want access-1", token, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("token wasn't stored: %v", err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("token stored with mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Expire the stored token; a new Source refreshes it without asking anyone.
+	data, _ := os.ReadFile(path)
+	data = regexp.MustCompile(`"expiry":"[^"]*"`).ReplaceAll(data, []byte(`"expiry":"2000-01-01T00:00:00Z"`))
+	os.WriteFile(path, data, 0o600)
+	prompt.Reset()
+	source = New(testConfig(server, configure.DeviceFlow, path), &prompt)
+	if err := source.Authorize(ctx); err != nil {
+		t.Fatalf("Authorize with stored token: %v", err)
+	}
+	if prompt.Len() != 0 {
+		t.Errorf("asked the user again despite the stored token: %q", prompt.String())
+	}
+	token, err = source.Token(ctx)
+	if err != nil || token != "access-2" {
+		t.Fatalf("Token = %q, %v, want the refreshed access-2", token, err)
+	}
+}
+
+func TestRevokedRefreshTokenNeedsAuthorization(t *testing.T) {
+	log.Init(false)
+	server := newTokenServer(t)
+	path := filepath.Join(t.TempDir(), "token.json")
+	os.WriteFile(path, []byte(`{"access_token":"old","refresh_token":"revoked","expiry":"2000-01-01T00:00:00Z"}`), 0o600)
+
+	source := New(testConfig(server, configure.DeviceFlow, path), &bytes.Buffer{})
+	if _, err := source.Token(context.Background()); !errors.Is(err, ErrNotAuthorized) {
+		t.Fatalf("Token with a revoked refresh token = %v, want ErrNotAuthorized", err)
+	}
+}
+
+func TestLoopbackFlow(t *testing.T) {
+	log.Init(false)
+	server := newTokenServer(t)
+	prompt := &syncBuffer{}
+	source := New(testConfig(server, configure.LoopbackFlow, ""), prompt)
+
+	done := make(chan error, 1)
+	go func() { done <- source.Authorize(context.Background()) }()
+
+	// Play the browser: follow the link back to our listener, as the provider would redirect it.
+	var link string
+	for link == "" {
+		time.Sleep(10 * time.Millisecond)
+		link = regexp.MustCompile(`http\S+/authorize\S+`).FindString(prompt.String())
+	}
+	authorize, _ := http.NewRequest(http.MethodGet, link, nil)
+	query := authorize.URL.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorization link %s doesn't use PKCE", link)
+	}
+	resp, err := http.Get(query.Get("redirect_uri") + "?code=auth-code&state=" + query.Get("state"))
+	if err != nil {
+		t.Fatalf("redirecting back: %v", err)
+	}
+	resp.Body.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if token, err := source.Token(context.Background()); err != nil || token != "access-1" {
+		t.Fatalf("Token = %q, %v, want access-1", token, err)
+	}
+}
+
+func TestXOAuth2InitialResponse(t *testing.T) {
+	mechanism, ir, err := SASLClient(configure.XOAuth2Auth, "me@example.com", "tok", "imap.example.com", 993).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mechanism != "XOAUTH2" || string(ir) != "user=me@example.com\x01auth=Bearer tok\x01\x01" {
+		t.Errorf("Start = %s %q", mechanism, ir)
+	}
+}
+
+// A buffer the flow can write to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,63 @@
+package oauth
+
+import (
+	"errors"
+	"net/smtp"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/jcc333/jkm/internal/configure"
+)
+
+// Presenting access tokens to the servers, by SASL.
+
+// A SASL client presenting an access token for username, by the given mechanism, to the server at host:port.
+func SASLClient(auth configure.Auth, username, token, host string, port int) sasl.Client {
+	if auth == configure.OAuthBearerAuth {
+		return sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+			Username: username,
+			Token:    token,
+			Host:     host,
+			Port:     port,
+		})
+	}
+	return &xoauth2Client{username: username, token: token}
+}
+
+// The XOAUTH2 mechanism, as Google and Microsoft take, which go-sasl doesn't have.
+type xoauth2Client struct {
+	username, token string
+}
+
+func (c *xoauth2Client) Start() (string, []byte, error) {
+	return "XOAUTH2", []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+// The server only challenges us to say why it refused the token, and waits for an empty response to fail.
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// SMTPAuth presents a SASL client's credentials to an SMTP server.
+// Like smtp.PlainAuth, it won't give them away over an unencrypted connection, except to localhost.
+func SMTPAuth(client sasl.Client) smtp.Auth {
+	return &smtpAuth{client: client}
+}
+
+type smtpAuth struct {
+	client sasl.Client
+}
+
+func (a *smtpAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return a.client.Start()
+}
+
+func (a *smtpAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return a.client.Next(fromServer)
+}
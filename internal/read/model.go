@@ -8,11 +8,16 @@ import (
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/dustin/go-humanize"
+	"github.com/jcc333/jkm/internal/chooser"
 	"github.com/jcc333/jkm/internal/commands"
+	"github.com/jcc333/jkm/internal/configure"
 	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/messages"
 )
 
+var selectedAttachmentStyle = lipgloss.NewStyle().Reverse(true)
+
 // Our reading model.
 // This component is responsible for displaying a single message.
 type readingModel struct {
@@ -30,10 +35,34 @@ type readingModel struct {
 
 	// Email client for fetching message details
 	receiver email.Receiver
+
+	// The (global) configuration settings.
+	cfg *configure.Config
+
+	// The index of the selected attachment.
+	attachment int
+
+	// A one-line report on the last thing done, e.g. saving attachments.
+	status string
+
+	// Picks the mailbox to move the message to.
+	chooser chooser.Model
+
+	// Whether the chooser is open, and so has the keys.
+	isChoosing bool
+
+	// Whether every header field is shown above the body.
+	isShowingHeaders bool
+
+	// Whether the message's source is shown in place of its body.
+	isShowingSource bool
+
+	// The message's source, once fetched.
+	source string
 }
 
 // Create a new reading model.
-func New(receiver email.Receiver, header *email.MessageHeader) *readingModel {
+func New(cfg *configure.Config, receiver email.Receiver, header *email.MessageHeader) *readingModel {
 	vp := viewport.New(0, 0)
 	return &readingModel{
 		viewport: vp,
@@ -41,19 +70,29 @@ func New(receiver email.Receiver, header *email.MessageHeader) *readingModel {
 		header:   header,
 		message:  nil,
 		receiver: receiver,
+		cfg:      cfg,
 	}
 }
 
 // Init the reading model as a tea view.
+// Opening a message marks it read.
 func (m readingModel) Init() tea.Cmd {
-	if m.header != nil {
-		return commands.FetchEmailBody(m.header.ID, m.receiver)
+	if m.header == nil {
+		return nil
 	}
-	return nil
+	fetch := commands.FetchEmailBody(m.header.ID, m.receiver)
+	if m.header.Flags.Has(email.Seen) {
+		return fetch
+	}
+	return tea.Batch(fetch, commands.SetFlag(m.receiver, m.header.ID, email.Seen, true))
 }
 
 // Render the reading view.
 func (m readingModel) View() string {
+	if m.isChoosing {
+		return m.chooser.View()
+	}
+
 	headerStr := m.headerStatusView()
 
 	var bodyStyle = lipgloss.NewStyle().
@@ -64,10 +103,64 @@ func (m readingModel) View() string {
 		BorderBottom(true)
 
 	return fmt.Sprintf("%s\n%s",
-		headerStr,
+		lipgloss.JoinVertical(lipgloss.Left, headerStr, m.attachmentsView()),
 		bodyStyle.Render(m.viewport.View()))
 }
 
+// Render the message's attachments, with the selected one highlighted.
+func (m readingModel) attachmentsView() string {
+	if m.message == nil || len(m.message.Attachments) == 0 {
+		return m.status
+	}
+
+	lines := []string{"Attachments (tab to select, w to save, W to save all):"}
+	for i, attachment := range m.message.Attachments {
+		name := attachment.Filename
+		if name == "" {
+			name = "(unnamed)"
+		}
+		line := fmt.Sprintf("  [%d] %s (%s, %s)", i+1, name, attachment.MIMEType, humanize.Bytes(uint64(attachment.Size)))
+		if i == m.attachment {
+			line = selectedAttachmentStyle.Render(line)
+		}
+		lines = append(lines, line)
+	}
+	if m.status != "" {
+		lines = append(lines, m.status)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// What the pager shows: the body, below every header field if they're shown, or else the message's source.
+func (m readingModel) content() string {
+	if m.isShowingSource {
+		if m.source == "" {
+			return "Loading message source..."
+		}
+		return m.source
+	}
+	if m.message == nil {
+		return "Loading message body..."
+	}
+	body := m.message.Body
+	if body == "" {
+		body = "[No message body available]"
+	}
+	if !m.isShowingHeaders {
+		return body
+	}
+	header := strings.TrimRight(strings.ReplaceAll(m.message.RawHeader, "\r\n", "\n"), "\n")
+	if header == "" {
+		header = "[The full header wasn't kept for this message]"
+	}
+	return header + "\n\n" + body
+}
+
+// Save attachments from the message to the download directory.
+func (m readingModel) save(attachments ...email.Attachment) tea.Cmd {
+	return commands.SaveAttachments(m.receiver, m.message.ID, attachments, m.cfg.DownloadDir)
+}
+
 func (m readingModel) headerView() string {
 	var headerStyle = lipgloss.NewStyle().
 		BorderStyle(lipgloss.NormalBorder()).
@@ -79,19 +172,16 @@ func (m readingModel) headerView() string {
 	}
 
 	from := fmt.Sprintf("From: %s", m.header.From)
-	to := fmt.Sprintf("To: %s", strings.Join(m.header.To, ", "))
+	to := fmt.Sprintf("To: %s", email.FormatAddresses(m.header.To))
 	subject := fmt.Sprintf("Subject: %s", m.header.Subject)
 	date := fmt.Sprintf("Date: %s", m.header.Date.Format(time.DateTime))
+	lines := []string{subject, from, to}
+	if len(m.header.Cc) > 0 {
+		lines = append(lines, fmt.Sprintf("Cc: %s", email.FormatAddresses(m.header.Cc)))
+	}
+	lines = append(lines, date)
 
-	return headerStyle.Render(
-		lipgloss.JoinVertical(
-			lipgloss.Left,
-			subject,
-			from,
-			to,
-			date,
-		),
-	)
+	return headerStyle.Render(lipgloss.JoinVertical(lipgloss.Left, lines...))
 }
 
 func (m readingModel) headerStatusView() string {
@@ -107,8 +197,35 @@ func (m readingModel) headerStatusView() string {
 		Width(100).
 		Bold(true)
 
-	return headerStyle.Render(fmt.Sprintf("From: %s\nSubject: %s\nReceived: %s",
-		m.header.From, m.header.Subject, m.header.Date.Format(time.DateTime)))
+	subject := m.header.Subject
+	if m.header.Flags.Has(email.Flagged) {
+		subject = "★ " + subject
+	}
+	lines := []string{fmt.Sprintf("From: %s", m.header.From)}
+	if len(m.header.Cc) > 0 {
+		lines = append(lines, fmt.Sprintf("Cc: %s", email.FormatAddresses(m.header.Cc)))
+	}
+	// Only our own drafts know who they blind copy.
+	if m.message != nil && len(m.message.Bcc) > 0 {
+		lines = append(lines, fmt.Sprintf("Bcc: %s", email.FormatAddresses(m.message.Bcc)))
+	}
+	lines = append(lines, fmt.Sprintf("Subject: %s", subject), fmt.Sprintf("Received: %s", m.header.Date.Format(time.DateTime)))
+	return headerStyle.Render(strings.Join(lines, "\n"))
+}
+
+// Handle messages while choosing a mailbox to move the message to.
+func (m readingModel) updateChooser(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+	m.chooser, cmd = m.chooser.Update(msg)
+	switch {
+	case m.chooser.IsCancelled:
+		m.isChoosing = false
+		return m, tea.WindowSize()
+	case m.chooser.Chosen != "":
+		m.isChoosing = false
+		return m, commands.MoveEmail(m.receiver, m.header.ID, m.chooser.Chosen)
+	}
+	return m, cmd
 }
 
 // Handle messages to the reading model.
@@ -119,6 +236,10 @@ func (m readingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds []tea.Cmd
 	)
 
+	if m.isChoosing {
+		return m.updateChooser(msg)
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
@@ -128,43 +249,130 @@ func (m readingModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.viewport.ScrollDown(1)
 		case "k", "up":
 			m.viewport.ScrollUp(1)
+		case "u":
+			if m.header != nil {
+				return m, commands.SetFlag(m.receiver, m.header.ID, email.Seen, !m.header.Flags.Has(email.Seen))
+			}
+		case "s":
+			if m.header != nil {
+				return m, commands.SetFlag(m.receiver, m.header.ID, email.Flagged, !m.header.Flags.Has(email.Flagged))
+			}
+		case "d":
+			if m.header != nil {
+				return m, commands.DeleteEmail(m.receiver, m.header.ID)
+			}
+		case "a":
+			if m.header != nil {
+				return m, commands.ArchiveEmail(m.receiver, m.header.ID)
+			}
+		case "m":
+			if m.header != nil {
+				m.chooser = chooser.New(m.receiver, fmt.Sprintf("Move %q to...", m.header.Subject))
+				m.isChoosing = true
+				return m, m.chooser.Init()
+			}
+		case "r", "R":
+			if m.message != nil {
+				return m, commands.ComposeDraft(email.Reply(*m.message, m.cfg.EmailAddress, msg.String() == "R"))
+			}
+		case "f":
+			if m.message != nil {
+				return m, commands.ComposeDraft(email.Forward(*m.message))
+			}
+		case "e":
+			if m.message != nil && m.message.Flags.Has(email.Draft) {
+				return m, commands.ResumeDraft(m.receiver, *m.message)
+			}
+		case "H":
+			if m.message != nil {
+				m.isShowingHeaders = !m.isShowingHeaders
+				m.viewport.SetContent(m.content())
+				m.viewport.GotoTop()
+			}
+		case "V":
+			if m.header != nil {
+				m.isShowingSource = !m.isShowingSource
+				m.viewport.SetContent(m.content())
+				m.viewport.GotoTop()
+				if m.isShowingSource && m.source == "" {
+					return m, commands.FetchSource(m.receiver, m.header.ID)
+				}
+			}
+		case "tab":
+			if m.message != nil && len(m.message.Attachments) > 0 {
+				m.attachment = (m.attachment + 1) % len(m.message.Attachments)
+			}
+		case "shift+tab":
+			if m.message != nil && len(m.message.Attachments) > 0 {
+				m.attachment = (m.attachment + len(m.message.Attachments) - 1) % len(m.message.Attachments)
+			}
+		case "w":
+			if m.message != nil && len(m.message.Attachments) > 0 {
+				m.status = "Saving attachment..."
+				return m, m.save(m.message.Attachments[m.attachment])
+			}
+		case "W":
+			if m.message != nil && len(m.message.Attachments) > 0 {
+				m.status = "Saving attachments..."
+				return m, m.save(m.message.Attachments...)
+			}
 		}
 
-	case tea.WindowSizeMsg:
-		headerHeight := lipgloss.Height(m.headerStatusView())
-		contentHeight := msg.Height - headerHeight - 2
-		m.viewport.Width = msg.Width
-		m.viewport.Height = contentHeight
-		if m.message != nil {
-			m.viewport.SetContent(m.message.Body)
-		} else if m.header != nil {
-			m.viewport.SetContent("Loading message body...")
+	case messages.FlagSet:
+		if m.header != nil && m.header.ID == msg.ID {
+			m.header.Flags = m.header.Flags.With(msg.Flag, msg.On)
+			switch {
+			case msg.Flag == email.Seen && !msg.On:
+				m.status = "Marked unread"
+			case msg.Flag == email.Flagged && msg.On:
+				m.status = "Starred"
+			case msg.Flag == email.Flagged:
+				m.status = "Unstarred"
+			}
 		}
 
-	case messages.FetchedBody:
-		// We got just the body content - create a full message from our header and this body
+	case messages.RemovedEmail:
+		// The message is gone, so there's nothing left to read.
 		if m.header != nil && m.header.ID == msg.ID {
-			m.message = &email.Message{
-				MessageHeader: *m.header,
-				Body:          msg.Body,
-			}
-			if msg.Body == "" {
-				m.viewport.SetContent("[No message body available]")
-			} else {
-				m.viewport.SetContent(msg.Body)
+			return m, commands.ListView()
+		}
+
+	case messages.FetchedSource:
+		if m.header != nil && m.header.ID == msg.ID {
+			// Shown as a pager would show it, without the carriage returns.
+			m.source = strings.ReplaceAll(msg.Source, "\r\n", "\n")
+			if m.isShowingSource {
+				m.viewport.SetContent(m.content())
 			}
-			cmds = append(cmds, tea.WindowSize())
+		}
+
+	case messages.SavedAttachments:
+		m.status = fmt.Sprintf("Saved %s", strings.Join(msg.Paths, ", "))
+
+	case messages.Offline:
+		m.status = "Not connected to the server; try again once it's back"
+
+	case tea.WindowSizeMsg:
+		headerHeight := lipgloss.Height(m.headerStatusView()) + lipgloss.Height(m.attachmentsView())
+		contentHeight := msg.Height - headerHeight - 2
+		m.viewport.Width = msg.Width
+		m.viewport.Height = contentHeight
+		if m.header != nil || m.message != nil {
+			m.viewport.SetContent(m.content())
 		}
 
 	case messages.FetchedOne:
+		// Ignore messages fetched for some other header.
+		if m.header != nil && msg.Message != nil && msg.Message.ID != m.header.ID {
+			break
+		}
 		m.message = msg.Message
 		if m.message != nil {
 			m.header = &m.message.MessageHeader
-			if m.message.Body == "" {
-				m.viewport.SetContent("[No message body available]")
-			} else {
-				m.viewport.SetContent(m.message.Body)
-			}
+			m.attachment = 0
+			m.viewport.SetContent(m.content())
+			// The attachments change the space left for the body.
+			cmds = append(cmds, tea.WindowSize())
 		} else {
 			m.viewport.SetContent("Error: Message could not be fetched")
 		}
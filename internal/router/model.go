@@ -1,14 +1,17 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	tea "github.com/charmbracelet/bubbletea"
 
+	"github.com/jcc333/jkm/internal/cache"
 	"github.com/jcc333/jkm/internal/commands"
 	"github.com/jcc333/jkm/internal/compose"
 	"github.com/jcc333/jkm/internal/configure"
+	"github.com/jcc333/jkm/internal/contacts"
 	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/errorview"
 	"github.com/jcc333/jkm/internal/io"
@@ -58,8 +61,17 @@ type model struct {
 	// The email layer underpinning the application.
 	mailer email.Client
 
+	// The address book recipients are suggested from, opened along with the mailer.
+	contacts *contacts.Book
+
 	// Track if we're currently sending an email to prevent duplicates, continue the spinner.
 	isSending bool
+
+	// The search whose results the list shows, if any, kept so they're still shown after reading one.
+	search string
+
+	// How the connection to the server last stood, kept so a new list can show it.
+	connection messages.ConnectionChanged
 }
 
 // Build a new router model.
@@ -68,7 +80,7 @@ func New(cfg *configure.Config) (*model, error) {
 
 	// Determine initial mode based on configuration completeness
 	initialMode := configureMode
-	if cfg.IMAPServer != "" && cfg.EmailAddress != "" && cfg.IMAPPassword != "" {
+	if cfg.IMAPServer != "" && cfg.EmailAddress != "" && (cfg.IMAPPassword != "" || cfg.UsesOAuth()) {
 		initialMode = listMode
 	}
 	var mailer email.Client
@@ -86,10 +98,17 @@ func New(cfg *configure.Config) (*model, error) {
 	} else {
 		log.Info("starting in list mode")
 		err := m.buildMailer()
-		if err != nil {
+		var certErr *email.CertificateError
+		switch {
+		case errors.As(err, &certErr):
+			// The certificate is worth seeing in full, to decide whether to trust it.
+			m.mode = errorMode
+			m.model = errorview.New(cfg, err)
+		case err != nil:
 			return nil, err
+		default:
+			m.model = list.New(m.cfg, m.mailer, []*email.MessageHeader{})
 		}
-		m.model = list.New([]*email.MessageHeader{})
 	}
 
 	return m, nil
@@ -106,20 +125,39 @@ func (m *model) buildMailer() error {
 		log.Info(err.Error())
 		return err
 	}
-	m.mailer = mailer
+	// Reading a message again is answered from memory, so that going back and forth between list and reader is instant.
+	m.mailer = cache.NewClient(mailer, m.cfg.BodyCacheBytes, m.cfg.BodyCacheMessages)
+	m.openContacts()
 	return nil
 }
 
+// Open the address book, or else keep one only for the session, since suggestions aren't worth stopping for.
+func (m *model) openContacts() {
+	book, err := contacts.Open(m.cfg.ContactsPath, m.cfg.EmailAddress)
+	if err != nil {
+		log.Warnf("Failed to open contacts at %s: %v", m.cfg.ContactsPath, err)
+		book, _ = contacts.Open("", m.cfg.EmailAddress)
+	}
+	m.contacts = book
+}
+
 // Close the model's mailer
 func (m *model) Disconnect() error {
 	log.Info("disconnecting mailer")
+	if m.mailer == nil {
+		return nil
+	}
 	return m.mailer.Disconnect()
 }
 
 // Initialize the router model.
 func (m *model) Init() tea.Cmd {
 	log.Info("init router")
-	return tea.Sequence(commands.RefreshEmails(m.mailer, true), m.model.Init(), commands.Tick())
+	return tea.Batch(
+		tea.Sequence(commands.LoadCachedEmails(m.mailer), commands.RefreshEmails(m.mailer, true), m.model.Init()),
+		commands.FetchMailboxes(m.mailer),
+		commands.WaitForUpdate(m.mailer),
+	)
 }
 
 // Handle updates to the model, generally by routing them to the routed model.
@@ -135,11 +173,19 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// Check for mode switch messages first
 	switch msg := msg.(type) {
 	case messages.ListMessages:
+		if m.search != "" {
+			return m, tea.Sequence(m.list(), commands.RefreshEmails(m.mailer, false), commands.SearchEmails(m.mailer, m.search))
+		}
 		return m, tea.Sequence(m.list(), commands.RefreshEmails(m.mailer, false))
 
 	case messages.ReadEmailMessage:
 		return m, tea.Sequence(m.read(msg.MessageHeader), commands.FetchEmailBody(msg.MessageHeader.ID, m.mailer))
 
+	case messages.FetchedOne:
+		model, cmd := m.model.Update(msg)
+		m.model = model
+		return m, tea.Batch(cmd, commands.HarvestContacts(m.contacts, msg.Message))
+
 	case messages.Err:
 		return m, m.recover(msg.Error)
 
@@ -148,7 +194,7 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m, m.recover(msg.Error)
 
 	case messages.ComposeMessage:
-		return m, m.compose()
+		return m, m.compose(msg.Draft)
 
 	case messages.SendEmail:
 		return m, commands.SendingEmail(msg)
@@ -160,20 +206,76 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 		m.isSending = true
 
-		sendingCmd := m.sending(msg.Recipient, msg.Subject, msg.Body)
-		sendCmd := m.sendMessage(msg.Recipient, msg.Subject, msg.Body)
+		sendingCmd := m.sending(msg.Message)
+		sendCmd := m.sendMessage(msg.Message)
 		return m, tea.Batch(sendingCmd, sendCmd)
 
+	case messages.SaveDraft:
+		return m, commands.StoreDraft(m.mailer, msg.Message)
+
+	case messages.SavedDraft:
+		compose.ForgetAutosave(m.cfg)
+		return m, tea.Sequence(m.list(), commands.RefreshEmails(m.mailer, true))
+
 	case messages.SentEmail:
 		m.isSending = false
+		compose.ForgetAutosave(m.cfg)
 		if m.mode == composeMode {
 			return m, commands.SentMessage()
 		} else {
 			return m, tea.Sequence(m.list(), commands.RefreshEmails(m.mailer, true))
 		}
 
-	case messages.Tick:
-		return m, tea.Batch(commands.RefreshEmails(m.mailer, false), commands.Tick())
+	case messages.MailboxUpdated:
+		log.Infof("mailbox updated: %#v", msg.Update)
+		cmds := []tea.Cmd{
+			commands.RefreshEmails(m.mailer, true),
+			commands.FetchMailboxes(m.mailer),
+			commands.WaitForUpdate(m.mailer),
+		}
+		if m.search != "" {
+			cmds = append(cmds, commands.SearchEmails(m.mailer, m.search))
+		}
+		return m, tea.Batch(cmds...)
+
+	case messages.ConnectionChanged:
+		m.connection = msg
+		cmds := []tea.Cmd{commands.WaitForUpdate(m.mailer)}
+		// Having stopped trying, for an untrusted certificate or a refused login, is for the user to see to.
+		// The certificate is worth seeing in full, to decide whether to trust it.
+		if msg.State == email.Offline && msg.Retry.IsZero() && msg.Err != nil {
+			return m, tea.Batch(append(cmds, m.recover(msg.Err))...)
+		}
+		// Whatever happened while we were away is waiting on the server.
+		if msg.State == email.Connected {
+			cmds = append(cmds, commands.RefreshEmails(m.mailer, true), commands.FetchMailboxes(m.mailer))
+			if m.search != "" {
+				cmds = append(cmds, commands.SearchEmails(m.mailer, m.search))
+			}
+		}
+		model, cmd := m.model.Update(msg)
+		m.model = model
+		return m, tea.Batch(append(cmds, cmd)...)
+
+	case messages.SelectMailbox:
+		return m, commands.ChangeMailbox(m.mailer, msg.Name)
+
+	case messages.SelectedMailbox:
+		cmds := []tea.Cmd{commands.RefreshEmails(m.mailer, true), commands.FetchMailboxes(m.mailer)}
+		// Search results are of the mailbox we just left.
+		if m.search != "" {
+			cmds = append(cmds, commands.ClearSearch())
+		}
+		return m, tea.Batch(cmds...)
+
+	case messages.SearchedEmails:
+		m.search = msg.Query
+
+	case messages.ClearedSearch:
+		m.search = ""
+		model, cmd := m.model.Update(msg)
+		m.model = model
+		return m, tea.Batch(cmd, commands.RefreshEmails(m.mailer, true))
 	}
 
 	model, cmd := m.model.Update(msg)
@@ -182,21 +284,24 @@ func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
-func (m *model) sendMessage(recipient string, subject string, body string) tea.Cmd {
+func (m *model) sendMessage(msg email.Message) tea.Cmd {
 	return func() tea.Msg {
-		msg := email.Message{
-			MessageHeader: email.MessageHeader{
-				From:    m.cfg.EmailAddress,
-				To:      []string{recipient},
-				Subject: subject,
-			},
-			Body: body,
-		}
+		msg.From = email.Address{Address: m.cfg.EmailAddress}
 
 		err := m.mailer.Send(msg)
 		if err != nil {
 			return messages.SendingFailure{Error: err}
 		}
+		m.contacts.HarvestSent(msg)
+		if err := m.contacts.Save(); err != nil {
+			log.Warnf("Failed to save contacts: %v", err)
+		}
+		// A finished draft has no business staying in the drafts mailbox.
+		if msg.Flags.Has(email.Draft) {
+			if err := m.mailer.DeleteDraft(msg); err != nil {
+				log.Warnf("Failed to delete sent draft %s: %v", msg.MessageID, err)
+			}
+		}
 
 		return messages.SentEmail{}
 	}
@@ -210,22 +315,34 @@ func (m *model) View() string {
 // List the emails in the inbox.
 func (m *model) list() tea.Cmd {
 	log.Info("listing emails")
+	var wait tea.Cmd
 	if m.mailer == nil {
 		err := m.buildMailer()
+		var certErr *email.CertificateError
+		if errors.As(err, &certErr) {
+			return m.recover(err)
+		}
 		if err != nil {
 			fmt.Printf("Error building mailer: %v\n", err)
 			os.Exit(1)
 		}
+		// We started without a mailer, so nobody is listening for updates yet.
+		wait = commands.WaitForUpdate(m.mailer)
 	}
 	m.mode = listMode
-	m.model = list.New([]*email.MessageHeader{})
-	return m.model.Init()
+	m.model = list.New(m.cfg, m.mailer, []*email.MessageHeader{})
+	cmds := []tea.Cmd{m.model.Init(), commands.FetchMailboxes(m.mailer), wait}
+	if m.connection.State != email.Connected {
+		connection := m.connection
+		cmds = append(cmds, func() tea.Msg { return connection })
+	}
+	return tea.Batch(cmds...)
 }
 
 // Read an email.
 func (m *model) read(header *email.MessageHeader) tea.Cmd {
 	m.mode = readMode
-	m.model = read.New(m.mailer, header)
+	m.model = read.New(m.cfg, m.mailer, header)
 	return m.model.Init()
 }
 
@@ -236,16 +353,16 @@ func (m *model) recover(err error) tea.Cmd {
 	return m.model.Init()
 }
 
-// Compose an email.
-func (m *model) compose() tea.Cmd {
+// Compose an email, starting from the given draft.
+func (m *model) compose(draft email.Message) tea.Cmd {
 	m.mode = composeMode
-	m.model = compose.New(m.cfg)
+	m.model = compose.New(m.cfg, draft, m.contacts)
 	return m.model.Init()
 }
 
 // Wait while the email sends.
-func (m *model) sending(recipient, subject, body string) tea.Cmd {
+func (m *model) sending(msg email.Message) tea.Cmd {
 	m.mode = sendingMode
-	m.model = sending.New(recipient, subject, body)
+	m.model = sending.New(msg)
 	return m.model.Init()
 }
@@ -5,6 +5,7 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/jcc333/jkm/internal/commands"
+	"github.com/jcc333/jkm/internal/email"
 	"github.com/jcc333/jkm/internal/messages"
 )
 
@@ -14,20 +15,18 @@ type model struct {
 	spinner spinner.Model
 
 	// Email details
-	recipient, subject, body string
+	message email.Message
 }
 
 // New creates a new sending model.
-func New(recipient, subject, body string) *model {
+func New(message email.Message) *model {
 	s := spinner.New()
 	s.Spinner = spinner.Dot
 	s.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("205"))
 
 	return &model{
-		spinner:   s,
-		recipient: recipient,
-		subject:   subject,
-		body:      body,
+		spinner: s,
+		message: message,
 	}
 }
 
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+// A local SQLite cache of mail.
+//
+// This lets the application start from what it last saw rather than waiting on the server,
+// and read previously fetched mail without a connection.
+// Messages are keyed by mailbox, UIDVALIDITY and UID: a UID only names the same message
+// for as long as its mailbox's UIDVALIDITY stays the same, so when that changes the mailbox is emptied here.
+
+const schema = `
+CREATE TABLE IF NOT EXISTS mailboxes (
+	name TEXT PRIMARY KEY,
+	delimiter TEXT NOT NULL DEFAULT '',
+	attributes TEXT NOT NULL DEFAULT '[]',
+	messages INTEGER NOT NULL DEFAULT 0,
+	unread INTEGER NOT NULL DEFAULT 0,
+	listed INTEGER NOT NULL DEFAULT 0,
+	uid_validity INTEGER NOT NULL DEFAULT 0,
+	uid_next INTEGER NOT NULL DEFAULT 0,
+	highest_modseq INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	mailbox TEXT NOT NULL,
+	uid_validity INTEGER NOT NULL,
+	uid INTEGER NOT NULL,
+	header TEXT NOT NULL,
+	flags INTEGER NOT NULL,
+	message TEXT,
+	PRIMARY KEY (mailbox, uid_validity, uid)
+);
+`
+
+// Store is the local cache of mail for one account.
+type Store struct {
+	db *sql.DB
+}
+
+// State is what we last knew of a mailbox on the server, to sync from.
+type State struct {
+	// The mailbox's UIDVALIDITY. Zero if we've never synced the mailbox.
+	UIDValidity uint32
+
+	// The UID the server will give the next message to arrive.
+	UIDNext uint32
+
+	// The highest modification sequence of any message, where the server has CONDSTORE.
+	HighestModSeq uint64
+}
+
+// Open the store at path, creating it if need be.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Infof("opened cache at %s", path)
+	return &Store{db: db}, nil
+}
+
+// Close the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// The mailboxes as last listed, in name order.
+func (s *Store) Mailboxes() ([]email.Mailbox, error) {
+	rows, err := s.db.Query(`SELECT name, delimiter, attributes, messages, unread FROM mailboxes WHERE listed ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mailboxes := []email.Mailbox{}
+	for rows.Next() {
+		var mailbox email.Mailbox
+		var attributes string
+		if err := rows.Scan(&mailbox.Name, &mailbox.Delimiter, &attributes, &mailbox.Messages, &mailbox.Unread); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(attributes), &mailbox.Attributes); err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, mailbox)
+	}
+	return mailboxes, rows.Err()
+}
+
+// Remember the mailboxes on the server, forgetting the listing of any others but not what's in them.
+func (s *Store) PutMailboxes(mailboxes []email.Mailbox) error {
+	return s.transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE mailboxes SET listed = 0`); err != nil {
+			return err
+		}
+		for _, mailbox := range mailboxes {
+			attributes, err := json.Marshal(mailbox.Attributes)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO mailboxes (name, delimiter, attributes, messages, unread, listed) VALUES (?, ?, ?, ?, ?, 1)
+				ON CONFLICT (name) DO UPDATE SET
+					delimiter = excluded.delimiter,
+					attributes = excluded.attributes,
+					messages = excluded.messages,
+					unread = excluded.unread,
+					listed = 1`,
+				mailbox.Name, mailbox.Delimiter, string(attributes), mailbox.Messages, mailbox.Unread)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// What we last knew of the named mailbox; the zero State if we've never synced it.
+func (s *Store) State(mailbox string) (State, error) {
+	var state State
+	err := s.db.QueryRow(`SELECT uid_validity, uid_next, highest_modseq FROM mailboxes WHERE name = ?`, mailbox).
+		Scan(&state.UIDValidity, &state.UIDNext, &state.HighestModSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return State{}, nil
+	}
+	return state, err
+}
+
+// Record what we now know of the named mailbox.
+// Messages cached under any other UIDVALIDITY are dropped, since their UIDs no longer mean anything.
+func (s *Store) SetState(mailbox string, state State) error {
+	return s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO mailboxes (name, uid_validity, uid_next, highest_modseq) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET
+				uid_validity = excluded.uid_validity,
+				uid_next = excluded.uid_next,
+				highest_modseq = excluded.highest_modseq`,
+			mailbox, state.UIDValidity, state.UIDNext, state.HighestModSeq)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM messages WHERE mailbox = ? AND uid_validity != ?`, mailbox, state.UIDValidity)
+		return err
+	})
+}
+
+// The cached headers of a mailbox's messages, newest first.
+func (s *Store) Headers(mailbox string, uidValidity uint32) ([]email.MessageHeader, error) {
+	rows, err := s.db.Query(`SELECT header, flags FROM messages WHERE mailbox = ? AND uid_validity = ? ORDER BY uid DESC`,
+		mailbox, uidValidity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	headers := []email.MessageHeader{}
+	for rows.Next() {
+		var encoded string
+		var flags email.Flag
+		if err := rows.Scan(&encoded, &flags); err != nil {
+			return nil, err
+		}
+		var header email.MessageHeader
+		if err := json.Unmarshal([]byte(encoded), &header); err != nil {
+			return nil, err
+		}
+		header.Flags = flags
+		headers = append(headers, header)
+	}
+	return headers, rows.Err()
+}
+
+// Cache the headers of some of a mailbox's messages, keeping any bodies already cached for them.
+func (s *Store) PutHeaders(mailbox string, uidValidity uint32, headers []email.MessageHeader) error {
+	return s.transact(func(tx *sql.Tx) error {
+		for _, header := range headers {
+			encoded, err := json.Marshal(header)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`
+				INSERT INTO messages (mailbox, uid_validity, uid, header, flags) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (mailbox, uid_validity, uid) DO UPDATE SET header = excluded.header, flags = excluded.flags`,
+				mailbox, uidValidity, header.ID, string(encoded), header.Flags)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update the cached flags of a message.
+func (s *Store) SetFlags(mailbox string, uidValidity uint32, id int, flags email.Flag) error {
+	_, err := s.db.Exec(`UPDATE messages SET flags = ? WHERE mailbox = ? AND uid_validity = ? AND uid = ?`,
+		flags, mailbox, uidValidity, id)
+	return err
+}
+
+// Forget messages which have left a mailbox.
+func (s *Store) Remove(mailbox string, uidValidity uint32, ids ...int) error {
+	return s.transact(func(tx *sql.Tx) error {
+		for _, id := range ids {
+			_, err := tx.Exec(`DELETE FROM messages WHERE mailbox = ? AND uid_validity = ? AND uid = ?`, mailbox, uidValidity, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The cached message, body and all, or nil if its body hasn't been cached.
+func (s *Store) Message(mailbox string, uidValidity uint32, id int) (*email.Message, error) {
+	var encoded sql.NullString
+	var flags email.Flag
+	err := s.db.QueryRow(`SELECT message, flags FROM messages WHERE mailbox = ? AND uid_validity = ? AND uid = ?`,
+		mailbox, uidValidity, id).Scan(&encoded, &flags)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !encoded.Valid {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msg email.Message
+	if err := json.Unmarshal([]byte(encoded.String), &msg); err != nil {
+		return nil, err
+	}
+	msg.Flags = flags
+	return &msg, nil
+}
+
+// Cache a whole message, body and all.
+func (s *Store) PutMessage(mailbox string, uidValidity uint32, msg *email.Message) error {
+	header, err := json.Marshal(msg.MessageHeader)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO messages (mailbox, uid_validity, uid, header, flags, message) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (mailbox, uid_validity, uid) DO UPDATE SET message = excluded.message`,
+		mailbox, uidValidity, msg.ID, string(header), msg.Flags, string(encoded))
+	return err
+}
+
+// Run f in a transaction, committing if it succeeds and rolling back if it doesn't.
+func (s *Store) transact(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
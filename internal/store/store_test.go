@@ -0,0 +1,127 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcc333/jkm/internal/email"
+	"github.com/jcc333/jkm/internal/log"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	log.Init(false)
+	s, err := Open(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestHeadersAndMessages(t *testing.T) {
+	s := openTestStore(t)
+	date := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	headers := []email.MessageHeader{
+		{ID: 1, From: email.Address{Address: "alice@example.com"}, Subject: "first", Date: date},
+		{ID: 2, From: email.Address{Address: "bob@example.com"}, Subject: "second", Date: date, Flags: email.Seen},
+	}
+	if err := s.PutHeaders(email.Inbox, 7, headers); err != nil {
+		t.Fatalf("Failed to put headers: %v", err)
+	}
+
+	msg := &email.Message{MessageHeader: headers[0], Body: "hello"}
+	if err := s.PutMessage(email.Inbox, 7, msg); err != nil {
+		t.Fatalf("Failed to put message: %v", err)
+	}
+	// Refreshing the headers keeps the body.
+	if err := s.PutHeaders(email.Inbox, 7, headers[:1]); err != nil {
+		t.Fatalf("Failed to put headers: %v", err)
+	}
+	if err := s.SetFlags(email.Inbox, 7, 1, email.Flagged); err != nil {
+		t.Fatalf("Failed to set flags: %v", err)
+	}
+
+	cached, err := s.Headers(email.Inbox, 7)
+	if err != nil {
+		t.Fatalf("Failed to get headers: %v", err)
+	}
+	if len(cached) != 2 || cached[0].ID != 2 || cached[1].ID != 1 {
+		t.Fatalf("Expected headers 2 then 1, got %+v", cached)
+	}
+	if cached[1].Flags != email.Flagged || !cached[1].Date.Equal(date) {
+		t.Errorf("Expected the flags and date to be kept, got %+v", cached[1])
+	}
+
+	read, err := s.Message(email.Inbox, 7, 1)
+	if err != nil || read == nil {
+		t.Fatalf("Failed to get message: %v", err)
+	}
+	if read.Body != "hello" || read.Flags != email.Flagged {
+		t.Errorf("Expected the cached body with the current flags, got %+v", read)
+	}
+	if read, err := s.Message(email.Inbox, 7, 2); err != nil || read != nil {
+		t.Errorf("Expected no message for an uncached body, got %+v, %v", read, err)
+	}
+
+	if err := s.Remove(email.Inbox, 7, 2); err != nil {
+		t.Fatalf("Failed to remove message: %v", err)
+	}
+	if cached, _ := s.Headers(email.Inbox, 7); len(cached) != 1 {
+		t.Errorf("Expected one header left, got %+v", cached)
+	}
+}
+
+func TestUIDValidityChange(t *testing.T) {
+	s := openTestStore(t)
+	if err := s.SetState(email.Inbox, State{UIDValidity: 7, UIDNext: 3}); err != nil {
+		t.Fatalf("Failed to set state: %v", err)
+	}
+	if err := s.PutHeaders(email.Inbox, 7, []email.MessageHeader{{ID: 1}, {ID: 2}}); err != nil {
+		t.Fatalf("Failed to put headers: %v", err)
+	}
+
+	if err := s.SetState(email.Inbox, State{UIDValidity: 8, UIDNext: 1}); err != nil {
+		t.Fatalf("Failed to set state: %v", err)
+	}
+	state, err := s.State(email.Inbox)
+	if err != nil || state.UIDValidity != 8 || state.UIDNext != 1 {
+		t.Errorf("Expected the new state, got %+v, %v", state, err)
+	}
+	if cached, _ := s.Headers(email.Inbox, 7); len(cached) != 0 {
+		t.Errorf("Expected messages under the old UIDVALIDITY to be dropped, got %+v", cached)
+	}
+}
+
+func TestMailboxes(t *testing.T) {
+	s := openTestStore(t)
+	if state, err := s.State("Archive"); err != nil || state != (State{}) {
+		t.Errorf("Expected no state for an unknown mailbox, got %+v, %v", state, err)
+	}
+
+	if err := s.SetState("Archive", State{UIDValidity: 3}); err != nil {
+		t.Fatalf("Failed to set state: %v", err)
+	}
+	mailboxes := []email.Mailbox{
+		{Name: email.Inbox, Delimiter: "/", Messages: 4, Unread: 1},
+		{Name: "Archive", Delimiter: "/", Attributes: []string{`\Archive`}},
+	}
+	if err := s.PutMailboxes(mailboxes); err != nil {
+		t.Fatalf("Failed to put mailboxes: %v", err)
+	}
+	if err := s.PutMailboxes(mailboxes[1:]); err != nil {
+		t.Fatalf("Failed to put mailboxes: %v", err)
+	}
+
+	cached, err := s.Mailboxes()
+	if err != nil {
+		t.Fatalf("Failed to get mailboxes: %v", err)
+	}
+	if len(cached) != 1 || cached[0].Name != "Archive" || !cached[0].Has(`\Archive`) {
+		t.Errorf("Expected only the archive to be listed, got %+v", cached)
+	}
+	if state, _ := s.State("Archive"); state.UIDValidity != 3 {
+		t.Errorf("Expected listing to keep the sync state, got %+v", state)
+	}
+}